@@ -13,6 +13,8 @@ type Backlog interface {
 	// Remove the next path from the backlog and return whether
 	// the backlog is now empty.
 	RemoveOne() (empty bool)
+	// Len returns the number of paths in the backlog.
+	Len() int
 }
 
 // A UnifiedBacklog only remembers one backlog item at a time.
@@ -52,6 +54,14 @@ func (b *UnifiedBacklog) RemoveOne() bool {
 	return true
 }
 
+// Len returns 1 if b holds a path and 0 otherwise.
+func (b *UnifiedBacklog) Len() int {
+	if b.empty {
+		return 0
+	}
+	return 1
+}
+
 // A UniqueFilesBacklog keeps a set of the paths it has received.
 type UniqueFilesBacklog struct {
 	empty bool
@@ -106,3 +116,71 @@ func (b *UniqueFilesBacklog) RemoveOne() bool {
 	delete(b.rest, b.next)
 	return false
 }
+
+// Len returns the number of paths in b.
+func (b *UniqueFilesBacklog) Len() int {
+	if b.empty {
+		return 0
+	}
+	return 1 + len(b.rest)
+}
+
+// An OrderedFilesBacklog is like a UniqueFilesBacklog, but it gives its paths
+// in the order they were first added (for --backlog-order=fifo).
+type OrderedFilesBacklog struct {
+	paths []string
+	seen  map[string]struct{}
+}
+
+func NewOrderedFilesBacklog() *OrderedFilesBacklog {
+	return &OrderedFilesBacklog{seen: make(map[string]struct{})}
+}
+
+// Add adds path to the end of b, unless it is already in b.
+func (b *OrderedFilesBacklog) Add(path string) {
+	if _, ok := b.seen[path]; ok {
+		return
+	}
+	b.seen[path] = struct{}{}
+	b.paths = append(b.paths, path)
+}
+
+// Next returns the path that was added to b first.
+func (b *OrderedFilesBacklog) Next() string {
+	if len(b.paths) == 0 {
+		panic("Next() called on empty backlog")
+	}
+	return b.paths[0]
+}
+
+// RemoveOne removes the path that was added to b first (the same path that was
+// returned by a preceding call to Next).
+func (b *OrderedFilesBacklog) RemoveOne() bool {
+	if len(b.paths) == 0 {
+		panic("RemoveOne() called on empty backlog")
+	}
+	delete(b.seen, b.paths[0])
+	b.paths = b.paths[1:]
+	return len(b.paths) == 0
+}
+
+// Len returns the number of paths in b.
+func (b *OrderedFilesBacklog) Len() int {
+	return len(b.paths)
+}
+
+// A LatestBacklog, like a UnifiedBacklog, holds one path at a time, but it
+// keeps the most recent one (for --backlog-order=latest).
+type LatestBacklog struct {
+	UnifiedBacklog
+}
+
+func NewLatestBacklog() *LatestBacklog {
+	return &LatestBacklog{UnifiedBacklog{empty: true}}
+}
+
+// Add replaces the path in b, if any, with path.
+func (b *LatestBacklog) Add(path string) {
+	b.s = path
+	b.empty = false
+}
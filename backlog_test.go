@@ -10,18 +10,28 @@ func TestUnifiedBacklog(t *testing.T) {
 	b := NewUnifiedBacklog()
 	b.Add("foo")
 	b.Add("bar")
+	if got, want := b.Len(), 1; got != want {
+		t.Errorf("Len(): got %d; want %d", got, want)
+	}
 	if got, want := b.Next(), "foo"; got != want {
 		t.Errorf("Next(): got %q; want %q", got, want)
 	}
 	if got := b.RemoveOne(); !got {
 		t.Error("RemoveOne(): got !empty")
 	}
+	if got, want := b.Len(), 0; got != want {
+		t.Errorf("Len(): got %d; want %d", got, want)
+	}
 }
 
 func TestUniqueFilesBacklog(t *testing.T) {
 	b := NewUniqueFilesBacklog()
 	b.Add("foo")
 	b.Add("bar")
+	b.Add("foo")
+	if got, want := b.Len(), 2; got != want {
+		t.Errorf("Len(): got %d; want %d", got, want)
+	}
 	s := []string{b.Next()}
 	if got := b.RemoveOne(); got {
 		t.Error("RemoveOne(): got empty")
@@ -30,8 +40,56 @@ func TestUniqueFilesBacklog(t *testing.T) {
 	if got := b.RemoveOne(); !got {
 		t.Error("RemoveOne(): got !empty")
 	}
+	if got, want := b.Len(), 0; got != want {
+		t.Errorf("Len(): got %d; want %d", got, want)
+	}
 	sort.Strings(s)
 	if want := []string{"bar", "foo"}; !reflect.DeepEqual(s, want) {
 		t.Errorf("Next() result set: got %v; want %v", s, want)
 	}
 }
+
+func TestOrderedFilesBacklog(t *testing.T) {
+	b := NewOrderedFilesBacklog()
+	for _, path := range []string{"c", "a", "c", "b", "a"} {
+		b.Add(path)
+	}
+	if got, want := b.Len(), 3; got != want {
+		t.Errorf("Len(): got %d; want %d", got, want)
+	}
+	var s []string
+	for {
+		s = append(s, b.Next())
+		if b.RemoveOne() {
+			break
+		}
+		if len(s) == 2 {
+			// A path that was removed can be added again.
+			b.Add("c")
+		}
+	}
+	if want := []string{"c", "a", "b", "c"}; !reflect.DeepEqual(s, want) {
+		t.Errorf("Next() results: got %v; want %v", s, want)
+	}
+	if got, want := b.Len(), 0; got != want {
+		t.Errorf("Len(): got %d; want %d", got, want)
+	}
+}
+
+func TestLatestBacklog(t *testing.T) {
+	b := NewLatestBacklog()
+	b.Add("foo")
+	b.Add("bar")
+	if got, want := b.Len(), 1; got != want {
+		t.Errorf("Len(): got %d; want %d", got, want)
+	}
+	if got, want := b.Next(), "bar"; got != want {
+		t.Errorf("Next(): got %q; want %q", got, want)
+	}
+	if got := b.RemoveOne(); !got {
+		t.Error("RemoveOne(): got !empty")
+	}
+	if got, want := b.Len(), 0; got != want {
+		t.Errorf("Len(): got %d; want %d", got, want)
+	}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,18 +19,63 @@ import (
 )
 
 type Config struct {
-	command         []string
-	source          string
-	regexes         []string
-	globs           []string
-	inverseRegexes  []string
-	inverseGlobs    []string
-	subSymbol       string
-	startService    bool
-	shutdownTimeout time.Duration
-	onlyFiles       bool
-	onlyDirs        bool
-	allFiles        bool
+	command           []string
+	source            string
+	name              string
+	regexes           []string
+	globs             []string
+	inverseRegexes    []string
+	inverseGlobs      []string
+	regexFiles        []string
+	globFiles         []string
+	inverseRegexFiles []string
+	inverseGlobFiles  []string
+	require           []string
+	subSymbol         string
+	substituteFirst   bool
+	backlogOrder      string
+	commandFormat     bool
+	shell             bool
+	startService      bool
+	noDefaultStart    bool
+	runAtStart        bool
+	shutdownTimeout   time.Duration
+	onlyFiles         bool
+	onlyDirs          bool
+	allFiles          bool
+	defaultIgnores    string
+	gitignore         bool
+	readyRegex        string
+	readyTCP          string
+	readyHTTP         string
+	readyTimeout      time.Duration
+	rawOutput         bool
+	noPty             bool
+	flushFirst        bool
+	debouncePerFile   bool
+	globDotfiles      bool
+	matchBasename     bool
+	ignoreCase        bool
+	onlyExecutable    bool
+	stdinFile         bool
+	runInNearest      string
+	thenCommands      []string
+	continueOnError   bool
+	stdoutFile        string
+	stderrFile        string
+	testMode          bool
+	watchBinary       bool
+	envFile           string
+	env               []string
+	noGroupKill       bool
+	debounce          time.Duration
+	maxLatency        time.Duration
+	maxRuntime        time.Duration
+	delay             time.Duration
+	restartSignal     string
+	minRestart        time.Duration
+	stopSignal        string
+	matchRealpath     bool
 }
 
 func (c *Config) registerFlags(f *flag.FlagSet) {
@@ -39,45 +89,245 @@ func (c *Config) registerFlags(f *flag.FlagSet) {
 	f.VarP(newMultiString(nil, &c.inverseGlobs), "inverse-glob", "G", `
             A shell glob expression to exclude matching filenames.
             (May be repeated.)`)
+	f.BoolVar(&c.globDotfiles, "glob-dotfiles", true, `
+            Let glob wildcards match a leading . in a path element
+            (unlike a shell, where * doesn't match .hidden).`)
+	f.BoolVarP(&c.ignoreCase, "ignore-case", "i", false, `
+            Match regexes and globs regardless of case (for
+            case-insensitive filesystems).`)
+	f.BoolVar(&c.matchBasename, "match-basename", false, `
+            Match globs without a / against the last element of each
+            path (so *.go matches foo/bar.go) rather than the whole path.`)
+	f.Var(newMultiString(nil, &c.regexFiles), "regex-from", `
+            A file of regular expressions (one per line) to match
+            filenames. (May be repeated.)`)
+	f.Var(newMultiString(nil, &c.inverseRegexFiles), "inverse-regex-from", `
+            A file of regular expressions (one per line) to exclude
+            matching filenames. (May be repeated.)`)
+	f.Var(newMultiString(nil, &c.globFiles), "glob-from", `
+            A file of shell glob expressions (one per line) to match
+            filenames. (May be repeated.)`)
+	f.Var(newMultiString(nil, &c.inverseGlobFiles), "inverse-glob-from", `
+            A file of shell glob expressions (one per line) to exclude
+            matching filenames. (May be repeated.)`)
+	f.Var(newMultiString(nil, &c.require), "require", `
+            A shell glob that some changed file in a batch must match
+            for the command to run. (May be repeated; the command only
+            runs once every such glob has been matched.)`)
 	f.StringVar(&c.subSymbol, "substitute", defaultSubSymbol, `
             The substitution symbol that is replaced with the filename
             in a command.`)
+	f.BoolVar(&c.substituteFirst, "substitute-first", false, `
+            Run the command once per batch of changes, substituting
+            only the first changed filename, rather than once for each
+            changed file.`)
+	f.StringVar(&c.backlogOrder, "backlog-order", "any", `
+            The order of the runs for the files in a batch, when the
+            command runs once per file. Choices: any, fifo (the order
+            in which the files first changed), latest (run just once,
+            for the file that changed last).`)
+	f.BoolVar(&c.commandFormat, "command-format", false, `
+            Treat the command as a printf-like template: %f is the
+            filename, %d its directory, %b its base name, %e its
+            extension, %n the number of files in the batch, and %% a
+            literal %. The {} tokens are not substituted.`)
+	f.BoolVarP(&c.shell, "shell", "S", false, `
+            Run the command with $SHELL -c (or /bin/sh -c), joining its
+            arguments with spaces. Substituted filenames are quoted.`)
 	f.BoolVarP(&c.startService, "start-service", "s", false, `
             Indicates that the command is a long-running process to be
             restarted on matching changes.`)
+	f.BoolVar(&c.noDefaultStart, "no-default-start", false, `
+            Don't start the service when reflex starts; wait for the
+            first matching change. (Only for --start-service.)`)
+	f.BoolVar(&c.runAtStart, "run-at-start", false, `
+            Run the command once when reflex starts, before any files
+            change. {} is replaced by nothing. (Not for --start-service,
+            --count, or --wait-for-one.)`)
+	f.BoolVar(&c.watchBinary, "watch-binary", false, `
+            Also restart the service when its executable changes on
+            disk, whether or not it matches the patterns.`)
+	f.StringVar(&c.restartSignal, "restart-signal", "", `
+            Instead of restarting the service when files change, send
+            it this signal (such as SIGHUP) to make it reload. If the
+            service isn't running, it is started.`)
+	f.DurationVar(&c.minRestart, "min-restart-interval", 0, `
+            The least time between starts of the service; a restart
+            that comes sooner waits (and changes in the meantime are
+            batched). (Only for --start-service.)`)
+	f.StringVar(&c.stopSignal, "stop-signal", "", `
+            A signal (such as SIGTERM) to send first when stopping the
+            command, instead of a ^C and then SIGINT. SIGKILL follows
+            if the command hasn't exited after --shutdown-timeout.`)
 	f.DurationVarP(&c.shutdownTimeout, "shutdown-timeout", "t", 500*time.Millisecond, `
             Allow services this long to shut down.`)
+	f.BoolVar(&c.noGroupKill, "no-process-group-kill", false, `
+            When stopping the command, signal only the command itself
+            rather than its whole process group. (Processes it started
+            may be left running.)`)
+	f.BoolVar(&c.matchRealpath, "match-realpath", false, `
+            Resolve symlinks in the paths of changed files before
+            matching them (and substituting them into the command).`)
 	f.BoolVar(&c.onlyFiles, "only-files", false, `
             Only match files (not directories).`)
 	f.BoolVar(&c.onlyDirs, "only-dirs", false, `
             Only match directories (not files).`)
+	f.BoolVar(&c.onlyExecutable, "only-executable", false, `
+            Only match executable files.`)
 	f.BoolVar(&c.allFiles, "all", false, `
             Include normally ignored files (VCS and editor special files).`)
+	f.StringVar(&c.defaultIgnores, "default-ignores", "vcs,editor,os", `
+            The groups of files to ignore by default, separated by
+            commas: vcs (.git and .hg), editor (Vim and Emacs
+            temporary files), and os (.DS_Store). (--all ignores none.)`)
+	f.BoolVar(&c.gitignore, "gitignore", false, `
+            Exclude the paths ignored by .gitignore and .reflexignore
+            files in the watched directory and its subdirectories.`)
+	f.StringVar(&c.readyRegex, "ready-regex", "", `
+            A regular expression matching a line of service output that
+            indicates that the service is ready. When a line matches,
+            reflex prints "Service ready".`)
+	f.StringVar(&c.readyTCP, "ready-tcp", "", `
+            A host:port that a service listens on. After starting the
+            service, reflex prints "Service ready" once it accepts a
+            TCP connection.`)
+	f.StringVar(&c.readyHTTP, "ready-http", "", `
+            An HTTP URL served by a service. After starting the service,
+            reflex prints "Service ready" once it responds to a GET
+            request with a non-5xx status.`)
+	f.DurationVar(&c.readyTimeout, "ready-timeout", 30*time.Second, `
+            How long to wait for --ready-tcp or --ready-http to succeed.`)
+	f.Var(newMultiString(nil, &c.thenCommands), "then", `
+            Another command to run after the main one succeeds. It is
+            split into arguments like a config file line and may use
+            substitutions. (May be repeated to run several in order.)`)
+	f.BoolVar(&c.continueOnError, "continue-on-error", false, `
+            Run the --then commands even if an earlier command fails.`)
+	f.BoolVar(&c.stdinFile, "stdin-file", false, `
+            Give the command the changed file as its standard input.
+            (A service gets empty input.)`)
+	f.StringVar(&c.runInNearest, "run-in-nearest", "", `
+            Run the command in the closest directory, from the changed
+            file up to the watched directory, that contains a file with
+            this name (such as Makefile).`)
+	f.Var(newMultiString(nil, &c.env), "env", `
+            A KEY=VALUE pair to add to the command's environment.
+            (May be repeated.)`)
+	f.StringVar(&c.envFile, "env-file", "", `
+            A file of KEY=VALUE lines to add to the command's
+            environment. It is read again each time the command runs.`)
+	f.StringVar(&c.stdoutFile, "stdout", "", `
+            Append the command's standard output to this file instead
+            of printing it.`)
+	f.StringVar(&c.stderrFile, "stderr", "", `
+            Append the command's standard error to this file instead
+            of printing it.`)
+	f.BoolVar(&c.testMode, "test-mode", false, `
+            Treat the command as a test: print just PASS when it
+            succeeds, and its output followed by FAIL when it fails.`)
+	f.DurationVar(&c.debounce, "debounce", 300*time.Millisecond, `
+            Wait until there have been no changes for this long before
+            running the command for a batch of changes.`)
+	f.DurationVar(&c.maxLatency, "max-latency", 0, `
+            Run the command at most this long after the first change of
+            a batch, even if changes keep coming. (0 means no limit.)`)
+	f.DurationVar(&c.delay, "delay", 0, `
+            Wait this long after a batch of changes before running the
+            command. For a service, a change during the wait starts it
+            over.`)
+	f.DurationVar(&c.maxRuntime, "max-runtime", 0, `
+            Stop the command if a run takes longer than this. (0 means
+            no limit; not for --start-service.)`)
+	f.BoolVar(&c.flushFirst, "flush-first", false, `
+            Run the command for the first change after a quiet period
+            right away instead of waiting for more changes to batch
+            with it.`)
+	f.BoolVar(&c.debouncePerFile, "debounce-per-file", false, `
+            Wait for --debounce separately for each changed file, so
+            that a file that keeps changing doesn't hold up changes to
+            other files.`)
+	f.StringVarP(&c.name, "name", "n", "", `
+            A name for the command, shown in place of its number in
+            the tag of each line of its output. (Each command's name
+            must be different.)`)
+	f.BoolVar(&c.noPty, "no-pty", false, `
+            Run the command with pipes for its output instead of a
+            pseudo-terminal. (Many programs then print no colors.)`)
+	f.BoolVar(&c.rawOutput, "raw-output", false, `
+            Copy the command's output through exactly as it is written,
+            without waiting for complete lines or adding decoration.
+            This keeps progress bars that use carriage returns intact.`)
 }
 
+// globalDirective starts a config file line that sets global flags (such as
+// --decoration or --sequential) rather than giving a command.
+const globalDirective = "!global"
+
+// flagSetRegexp matches the name of a set of flags defined in a config file
+// (by a line starting with a new name, like "@common -R vendor/") to be used
+// on later lines in place of the name.
+var flagSetRegexp = regexp.MustCompile(`^@[A-Za-z0-9_-]+$`)
+
 // ReadConfigs reads configurations from either a file or, as a special case,
-// stdin if "-" is given for path.
-func ReadConfigs(path string) ([]*Config, error) {
+// stdin if "-" is given for path. It also returns the arguments of the file's
+// !global lines. A file whose name ends in .json is read with
+// readJSONConfigs instead; one ending in .yaml or .yml is rejected rather than
+// misread as lines of flags.
+func ReadConfigs(path string) ([]*Config, []string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return nil, nil, fmt.Errorf("%s: YAML config files are not supported (use the line format or .json)", path)
+	}
 	var r io.Reader
 	name := path
 	if path == "-" {
 		r = os.Stdin
 		name = "standard input"
 	} else {
-		f, err := os.Open(flagConf)
+		f, err := os.Open(path)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		defer f.Close()
 		r = f
 	}
-	return readConfigsFromReader(r, name)
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		configs, err := readJSONConfigs(r, name)
+		return configs, nil, err
+	}
+	return readConfigFile(r, name)
+}
+
+// confirmConfigs writes the commands of configs to w and asks whether to run
+// them, reading the answer from r. It reports whether the user answered yes.
+func confirmConfigs(r io.Reader, w io.Writer, configs []*Config) bool {
+	fmt.Fprintln(w, "The configuration will run these commands:")
+	for _, c := range configs {
+		fmt.Fprintf(w, "  %s: %s\n", c.source, shellquote.Join(c.command...))
+	}
+	fmt.Fprint(w, "Run them? [y/N] ")
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
 }
 
+// readConfigsFromReader reads the commands of a config file from r. Any
+// !global lines are skipped.
 func readConfigsFromReader(r io.Reader, name string) ([]*Config, error) {
+	configs, _, err := readConfigFile(r, name)
+	return configs, err
+}
+
+// readConfigFile reads a config file from r, returning its commands and the
+// arguments of its !global lines, which must come before any command. Flag
+// sets defined by @name lines are expanded on the lines that follow.
+func readConfigFile(r io.Reader, name string) (configs []*Config, globals []string, err error) {
 	scanner := bufio.NewScanner(r)
 	lineNo := 0
-	var configs []*Config
+	flagSets := make(map[string][]string)
 parseFile:
 	for scanner.Scan() {
 		lineNo++
@@ -89,9 +339,7 @@ parseFile:
 
 		// Found a command line; begin parsing it
 		errorf := fmt.Sprintf("error on line %d of %s: %%s", lineNo, name)
-
-		c := &Config{}
-		c.source = fmt.Sprintf("%s, line %d", name, lineNo)
+		startLine := lineNo
 
 		line := scanner.Text()
 		parts, err := shellquote.Split(line)
@@ -108,7 +356,7 @@ parseFile:
 					break parseFile
 				}
 				// EOF, return the most recent error with the line where the command started
-				return nil, fmt.Errorf(errorf, err)
+				return nil, nil, fmt.Errorf(errorf, err)
 			}
 			// append the next line and parse again
 			lineNo++
@@ -116,21 +364,424 @@ parseFile:
 			parts, err = shellquote.Split(line)
 		}
 
-		flags := flag.NewFlagSet("", flag.ContinueOnError)
-		flags.SetOutput(ioutil.Discard)
-		c.registerFlags(flags)
-		if err := flags.Parse(parts); err != nil {
-			return nil, fmt.Errorf(errorf, err)
+		if flagExpandEnv {
+			for i, part := range parts {
+				parts[i] = expandEnv(part)
+			}
+		}
+
+		// A line starting with a new @name defines it; one starting
+		// with a defined @name uses it.
+		if len(parts) > 0 && flagSetRegexp.MatchString(parts[0]) && flagSets[parts[0]] == nil {
+			if len(parts) == 1 {
+				return nil, nil, fmt.Errorf(errorf, parts[0]+" has no flags")
+			}
+			flags, command := expandFlagSets(parts[1:], flagSets)
+			if command < len(flags) {
+				return nil, nil, fmt.Errorf(errorf, parts[0]+" may only contain flags (found "+flags[command]+")")
+			}
+			flagSets[parts[0]] = flags
+			continue
+		}
+		parts, _ = expandFlagSets(parts, flagSets)
+
+		if len(parts) > 0 && parts[0] == globalDirective {
+			if len(configs) > 0 {
+				return nil, nil, fmt.Errorf(errorf, globalDirective+" lines must come before any commands")
+			}
+			globals = append(globals, parts[1:]...)
+			continue
+		}
+
+		c, err := parseConfig(parts, fmt.Sprintf("%s, line %d", name, startLine))
+		if err != nil {
+			return nil, nil, fmt.Errorf(errorf, err)
 		}
-		c.command = flags.Args()
 		configs = append(configs, c)
 	}
 	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error reading config from %s: %s", name, err)
+	}
+	return configs, globals, nil
+}
+
+// expandFlagSets replaces each of parts that names one of flagSets with the
+// flags in the set, up to the first "--" or argument that isn't a flag (or a
+// flag's value), where the command starts; the command is left as it is. It
+// also returns the index in expanded where the command starts (len(expanded)
+// if there is none).
+func expandFlagSets(parts []string, flagSets map[string][]string) (expanded []string, command int) {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	new(Config).registerFlags(flags)
+	for i := 0; i < len(parts); i++ {
+		part := parts[i]
+		if set, ok := flagSets[part]; ok {
+			expanded = append(expanded, set...)
+			continue
+		}
+		if part == "--" || part == "-" || !strings.HasPrefix(part, "-") {
+			return append(expanded, parts[i:]...), len(expanded)
+		}
+		expanded = append(expanded, part)
+		if takesValue(flags, part) && i+1 < len(parts) {
+			i++
+			expanded = append(expanded, parts[i])
+		}
+	}
+	return expanded, len(expanded)
+}
+
+// takesValue reports whether arg, one of the flags in flags, is followed by
+// its value as the next argument (as with "-r regex" or "--glob pattern").
+func takesValue(flags *flag.FlagSet, arg string) bool {
+	if strings.HasPrefix(arg, "--") {
+		if strings.Contains(arg, "=") {
+			return false
+		}
+		f := flags.Lookup(arg[2:])
+		return f != nil && !isBoolFlag(f)
+	}
+	// Shorthands may be combined (as in -sv); the first one that takes a
+	// value gets the rest of arg or, if there's nothing left, the next
+	// argument.
+	shorthands := arg[1:]
+	for i := range shorthands {
+		var f *flag.Flag
+		flags.VisitAll(func(candidate *flag.Flag) {
+			if candidate.Shorthand == shorthands[i:i+1] {
+				f = candidate
+			}
+		})
+		if f == nil {
+			return false
+		}
+		if !isBoolFlag(f) {
+			return i == len(shorthands)-1
+		}
+	}
+	return false
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// parseConfig makes a Config from the flags and command in parts (the
+// arguments as they'd be given to reflex).
+func parseConfig(parts []string, source string) (*Config, error) {
+	c := &Config{source: source}
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	c.registerFlags(flags)
+	if err := flags.Parse(parts); err != nil {
+		return nil, err
+	}
+	c.command = flags.Args()
+	return c, nil
+}
+
+// flagArgs returns the flags that configure c as they would be written in a
+// config file (the inverse of parseConfig): each flag that differs from its
+// default, by its long name.
+func (c *Config) flagArgs() []string {
+	copied := *c
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	copied.registerFlags(flags)
+	// Registering the flags reset copied to the defaults. The flags point
+	// at its fields, so this gives them c's values.
+	copied = *c
+	var args []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if ms, ok := f.Value.(*multiString); ok {
+			for _, val := range *ms.vals {
+				args = append(args, "--"+f.Name+"="+val)
+			}
+			return
+		}
+		val := f.Value.String()
+		if val == f.DefValue {
+			return
+		}
+		if isBoolFlag(f) && val == "true" {
+			args = append(args, "--"+f.Name)
+		} else {
+			args = append(args, "--"+f.Name+"="+val)
+		}
+	})
+	return args
+}
+
+// safeArgRegexp matches arguments that needn't be quoted in a config file
+// line.
+var safeArgRegexp = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./{}-]+$`)
+
+// joinArgs joins args into a config file line, single-quoting the arguments
+// (or, for --flag=value, the values) that need it.
+func joinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		prefix := ""
+		if strings.HasPrefix(arg, "--") {
+			if j := strings.Index(arg, "="); j >= 0 {
+				prefix, arg = arg[:j+1], arg[j+1:]
+			}
+		}
+		if !safeArgRegexp.MatchString(arg) {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		quoted[i] = prefix + arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// envConfigRegexp matches the names of the environment variables read by
+// readConfigsFromEnv: REFLEX_<N>_<FLAG> or REFLEX_<N>_COMMAND.
+var envConfigRegexp = regexp.MustCompile(`^REFLEX_([0-9]+)_([A-Z0-9_]+)$`)
+
+// readConfigsFromEnv makes Configs from environment variables (given as
+// KEY=value strings, as from os.Environ), for --from-env. Each
+// REFLEX_<N>_COMMAND variable is a command, split into arguments like a config
+// file line, and each REFLEX_<N>_<FLAG> variable sets a flag for it, where
+// FLAG is the flag name in upper case with underscores for dashes (so
+// REFLEX_0_START_SERVICE=true is --start-service=true). The Configs are
+// ordered by N.
+func readConfigsFromEnv(environ []string) ([]*Config, error) {
+	type envConfig struct {
+		flags   []string
+		command string
+		hasCmd  bool
+	}
+	byNum := make(map[int]*envConfig)
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		key, value := kv[:i], kv[i+1:]
+		m := envConfigRegexp.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad environment variable %s: %s", key, err)
+		}
+		ec, ok := byNum[n]
+		if !ok {
+			ec = &envConfig{}
+			byNum[n] = ec
+		}
+		if m[2] == "COMMAND" {
+			ec.command = value
+			ec.hasCmd = true
+			continue
+		}
+		flagName := strings.ToLower(strings.Replace(m[2], "_", "-", -1))
+		ec.flags = append(ec.flags, "--"+flagName+"="+value)
+	}
+
+	var nums []int
+	for n := range byNum {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	var configs []*Config
+	for _, n := range nums {
+		ec := byNum[n]
+		source := fmt.Sprintf("environment, REFLEX_%d_*", n)
+		if !ec.hasCmd {
+			return nil, fmt.Errorf("%s: REFLEX_%d_COMMAND is not set", source, n)
+		}
+		command, err := shellquote.Split(ec.command)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad REFLEX_%d_COMMAND: %s", source, n, err)
+		}
+		// Sort the flags so that the result doesn't depend on the order
+		// of the environment.
+		sort.Strings(ec.flags)
+		parts := append(ec.flags, "--")
+		parts = append(parts, command...)
+		c, err := parseConfig(parts, source)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", source, err)
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+// readJSONConfigs reads configurations from a JSON array of objects, one for
+// each command. The "command" key is the command, either as an array of
+// arguments or as a string that is split like a config file line. Every other
+// key is a flag name (with dashes or underscores) whose value is a string,
+// number, or boolean, or an array of them for a flag that may be repeated:
+//
+//	[{"regex": ["\\.go$"], "start_service": true, "command": "go run ."}]
+func readJSONConfigs(r io.Reader, name string) ([]*Config, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var objects []map[string]interface{}
+	if err := dec.Decode(&objects); err != nil {
 		return nil, fmt.Errorf("error reading config from %s: %s", name, err)
 	}
+	var configs []*Config
+	for i, obj := range objects {
+		source := fmt.Sprintf("%s, command %d", name, i+1)
+		c, err := parseJSONConfig(obj, source)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", source, err)
+		}
+		configs = append(configs, c)
+	}
 	return configs, nil
 }
 
+// parseJSONConfig makes a Config from one object of a JSON config file.
+func parseJSONConfig(obj map[string]interface{}, source string) (*Config, error) {
+	var command []string
+	switch v := obj["command"].(type) {
+	case nil:
+		return nil, fmt.Errorf("no command")
+	case string:
+		var err error
+		if command, err = shellquote.Split(v); err != nil {
+			return nil, fmt.Errorf("bad command: %s", err)
+		}
+	case []interface{}:
+		for _, arg := range v {
+			s, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("bad command: %v is not a string", arg)
+			}
+			command = append(command, s)
+		}
+	default:
+		return nil, fmt.Errorf("bad command: %v is not a string or an array", v)
+	}
+
+	// Sort the keys so that the flags come in a fixed order.
+	var keys []string
+	for key := range obj {
+		if key != "command" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		flagName := strings.Replace(key, "_", "-", -1)
+		values, ok := obj[key].([]interface{})
+		if !ok {
+			values = []interface{}{obj[key]}
+		}
+		for _, value := range values {
+			switch value.(type) {
+			case string, bool, json.Number:
+			default:
+				return nil, fmt.Errorf("bad value for %s: %v", key, value)
+			}
+			parts = append(parts, fmt.Sprintf("--%s=%v", flagName, value))
+		}
+	}
+	parts = append(parts, "--")
+	parts = append(parts, command...)
+	if flagExpandEnv {
+		for i, part := range parts {
+			parts[i] = expandEnv(part)
+		}
+	}
+	return parseConfig(parts, source)
+}
+
+// expandEnv replaces $VAR and ${VAR} in s with the values of the environment
+// variables. $$ is replaced with $.
+func expandEnv(s string) string {
+	return os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
+	})
+}
+
+// readPatternFiles returns patterns with the patterns from each of the given
+// files appended.
+func readPatternFiles(patterns []string, paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return patterns, nil
+	}
+	result := append([]string(nil), patterns...)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		filePatterns, err := readPatterns(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading patterns from %s: %s", path, err)
+		}
+		result = append(result, filePatterns...)
+	}
+	return result, nil
+}
+
+// readPatterns reads patterns, one per line, from r. As in config files, empty
+// lines and lines starting with # are skipped.
+func readPatterns(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	var patterns []string
+	for scanner.Scan() {
+		trimmed := strings.TrimSpace(scanner.Text())
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		patterns = append(patterns, trimmed)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// readEnvFile reads environment variables, as KEY=VALUE lines, from the file
+// called name (for --env-file). Empty lines, lines starting with #, and a
+// leading "export " are skipped, and the value may be enclosed in single or
+// double quotes.
+func readEnvFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	var env []string
+	for scanner.Scan() {
+		lineNo++
+		trimmed := strings.TrimSpace(scanner.Text())
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		trimmed = strings.TrimPrefix(trimmed, "export ")
+		i := strings.Index(trimmed, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d of %s is not of the form KEY=VALUE", lineNo, name)
+		}
+		key := strings.TrimSpace(trimmed[:i])
+		value := strings.TrimSpace(trimmed[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, key+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
 // A multiString is a flag.Getter which collects repeated string flags.
 type multiString struct {
 	vals *[]string
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -32,14 +34,24 @@ world"
 			source:          "test input, line 1",
 			globs:           []string{"*.go"},
 			subSymbol:       "{}",
+			backlogOrder:    "any",
+			defaultIgnores:  "vcs,editor,os",
 			shutdownTimeout: 500 * time.Millisecond,
+			readyTimeout:    30 * time.Second,
+			debounce:        300 * time.Millisecond,
+			globDotfiles:    true,
 		},
 		{
 			command:         []string{"echo", "[]"},
 			source:          "test input, line 4",
 			regexes:         []string{`^a[0-9]+\.txt$`},
 			subSymbol:       "[]",
+			backlogOrder:    "any",
+			defaultIgnores:  "vcs,editor,os",
 			shutdownTimeout: 500 * time.Millisecond,
+			readyTimeout:    30 * time.Second,
+			debounce:        300 * time.Millisecond,
+			globDotfiles:    true,
 			onlyDirs:        true,
 		},
 		{
@@ -47,8 +59,13 @@ world"
 			source:          "test input, line 6",
 			globs:           []string{"*.go"},
 			subSymbol:       "{}",
+			backlogOrder:    "any",
+			defaultIgnores:  "vcs,editor,os",
 			startService:    true,
 			shutdownTimeout: 500 * time.Millisecond,
+			readyTimeout:    30 * time.Second,
+			debounce:        300 * time.Millisecond,
+			globDotfiles:    true,
 			onlyFiles:       true,
 		},
 		{
@@ -59,7 +76,12 @@ world"
 			inverseRegexes:  []string{"baz"},
 			inverseGlobs:    []string{"b", "c"},
 			subSymbol:       "{}",
+			backlogOrder:    "any",
+			defaultIgnores:  "vcs,editor,os",
 			shutdownTimeout: 500 * time.Millisecond,
+			readyTimeout:    30 * time.Second,
+			debounce:        300 * time.Millisecond,
+			globDotfiles:    true,
 		},
 	}
 	if !reflect.DeepEqual(got, want) {
@@ -68,6 +90,31 @@ world"
 	}
 }
 
+func TestReadConfigGlobals(t *testing.T) {
+	const in = `# Settings for the whole file.
+!global --sequential \
+	--decoration=fancy
+!global -v
+
+-g '*.go' echo {}
+`
+	configs, globals, err := readConfigFile(strings.NewReader(in), "test input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 {
+		t.Errorf("got %d configs; want 1", len(configs))
+	}
+	if want := []string{"--sequential", "--decoration=fancy", "-v"}; !reflect.DeepEqual(globals, want) {
+		t.Errorf("globals: got %q; want %q", globals, want)
+	}
+
+	const late = "-g '*.go' echo {}\n!global --sequential\n"
+	if _, _, err := readConfigFile(strings.NewReader(late), "test input"); err == nil {
+		t.Error("readConfigFile with a !global line after a command: got nil error")
+	}
+}
+
 func TestReadConfigsBad(t *testing.T) {
 	for _, in := range []string{
 		"",
@@ -75,15 +122,415 @@ func TestReadConfigsBad(t *testing.T) {
 		"-g '*.go'",
 		"--substitute='' echo hi",
 		"-s echo {}",
+		"-s echo {match:1}",
+		"-s echo {count}",
+		"--command-format -s echo %f",
+		"--command-format -s echo %n",
+		"--command-format echo %x",
+		"--command-format echo 100%",
+		"--require='[' echo hi",
+		"-s --run-in-nearest=Makefile make",
+		"--min-restart-interval=1s make",
+		"-s --min-restart-interval=-1s ./server",
+		"--no-default-start echo hi",
+		"-s --run-at-start echo hi",
 		"--only-files --only-dirs echo hi",
+		"--only-executable --only-dirs echo hi",
+		"--ready-regex listening echo hi",
+		"-s --ready-regex '(' echo hi",
+		"-s --ready-tcp localhost echo hi",
+		"-s --ready-http localhost:8080 echo hi",
+		"-s --ready-regex listening --ready-tcp :8080 echo hi",
+		"-s --raw-output --ready-regex listening echo hi",
+		"-s --then='echo bye' echo hi",
+		"--then='' echo hi",
+		"--then='echo \"bye' echo hi",
+		"--continue-on-error echo hi",
+		"-s --test-mode echo hi",
+		"--watch-binary echo hi",
+		"--restart-signal=HUP echo hi",
+		"-s --restart-signal=NOPE echo hi",
+		"-s --restart-signal=HUP --watch-binary echo hi",
+		"--stop-signal=NOPE echo hi",
+		"--debounce=0 echo hi",
+		"--debounce=-1s echo hi",
+		"--max-latency=-1s echo hi",
+		"--max-runtime=-1s echo hi",
+		"--delay=-1s echo hi",
+		"-s --max-runtime=1m ./server",
+		"--debounce-per-file --flush-first echo hi",
+		"--debounce-per-file --max-latency=1s echo hi",
+		"--env-file=/nonexistent/.env echo hi",
+		"--env=NOEQUALS echo hi",
+		"--backlog-order=lifo echo {}",
+		"--default-ignores=vcs,ide echo hi",
+		"--backlog-order=fifo echo hi",
+		"--backlog-order=fifo --substitute-first echo {}",
+		"--env==value echo hi",
+		"-s --stdout=out.log --stderr=err.log --ready-regex listening echo hi",
+		"-s --then='echo {}' echo hi",
 	} {
 		r := strings.NewReader(in)
-		if configs, err := readConfigsFromReader(r, "test input"); err == nil {
-			for _, config := range configs {
-				if _, err := NewReflex(config); err == nil {
-					t.Errorf("readConfigsFromReader(%q): got nil error", in)
-				}
+		configs, err := readConfigsFromReader(r, "test input")
+		if err != nil {
+			if !strings.Contains(err.Error(), "line 1 of test input") {
+				t.Errorf("readConfigsFromReader(%q): got error %q; want it to name the line", in, err)
+			}
+			continue
+		}
+		for _, config := range configs {
+			_, err := NewReflex(config)
+			if err == nil {
+				t.Errorf("readConfigsFromReader(%q): got nil error", in)
+				continue
 			}
+			// Errors from NewReflex say which line they're about.
+			if !strings.HasPrefix(err.Error(), "test input, line 1: ") {
+				t.Errorf("NewReflex for %q: got error %q; want it to name the line", in, err)
+			}
+		}
+	}
+}
+
+func TestNewReflexErrorSource(t *testing.T) {
+	in := "# Build.\necho hi\n\n-g '*.go'\n"
+	configs, err := readConfigsFromReader(strings.NewReader(in), "test input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReflex(configs[0]); err != nil {
+		t.Fatalf("line 2: %s", err)
+	}
+	_, err = NewReflex(configs[1])
+	if err == nil {
+		t.Fatal("line 4: got nil error for a line without a command")
+	}
+	if want := "test input, line 4: must give command to execute"; err.Error() != want {
+		t.Errorf("got error %q; want %q", err, want)
+	}
+}
+
+func TestConfigFlagArgs(t *testing.T) {
+	for _, line := range []string{
+		"echo hi",
+		"-g '*.go' -G 'vendor/*' -r \"it's\" --substitute='[]' -- echo []",
+		"-s -t 2s --ready-regex='listening on :[0-9]+' --then=true -- ./server --port=8080",
+		"--all --glob-dotfiles=false --then='echo a' --then='echo b' make",
+	} {
+		configs, err := readConfigsFromReader(strings.NewReader(line), "test input")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := configs[0]
+		args := append(want.flagArgs(), "--")
+		args = append(args, want.command...)
+		joined := joinArgs(args)
+		configs, err = readConfigsFromReader(strings.NewReader(joined), "test input")
+		if err != nil {
+			t.Fatalf("flagArgs for %q gave %q, which cannot be read: %s", line, joined, err)
+		}
+		if got := configs[0]; !reflect.DeepEqual(got, want) {
+			t.Errorf("flagArgs for %q gave %q, which reads differently:\n%s",
+				line, joined, strings.Join(pretty.Diff(got, want), "\n"))
+		}
+	}
+}
+
+func TestReadPatterns(t *testing.T) {
+	const in = `# Build output
+^build/
+
+  \.o$
+# Generated code
+_gen\.go$
+`
+	got, err := readPatterns(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`^build/`, `\.o$`, `_gen\.go$`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readPatterns: got %q; want %q", got, want)
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	const in = `# Database settings
+DB_HOST=localhost
+export DB_USER = admin
+
+DB_PASS="p=ss word"
+EMPTY=
+QUOTE='"'
+`
+	if _, err := f.WriteString(in); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	got, err := readEnvFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"DB_HOST=localhost", "DB_USER=admin", "DB_PASS=p=ss word", "EMPTY=", `QUOTE="`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readEnvFile: got %q; want %q", got, want)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("NOT_A_VAR\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readEnvFile(f.Name()); err == nil {
+		t.Error("readEnvFile with a bad line: got nil error")
+	}
+}
+
+func TestReadConfigsExpandEnv(t *testing.T) {
+	defer func(expand bool) { flagExpandEnv = expand }(flagExpandEnv)
+	os.Setenv("REFLEX_TEST_SRC", "src dir")
+	defer os.Unsetenv("REFLEX_TEST_SRC")
+
+	const in = `-g '$REFLEX_TEST_SRC/*.go' echo ${REFLEX_TEST_SRC} $$HOME '$$' $REFLEX_TEST_UNSET`
+	for _, tt := range []struct {
+		expand  bool
+		globs   []string
+		command []string
+	}{
+		{
+			false,
+			[]string{"$REFLEX_TEST_SRC/*.go"},
+			[]string{"echo", "${REFLEX_TEST_SRC}", "$$HOME", "$$", "$REFLEX_TEST_UNSET"},
+		},
+		{
+			true,
+			[]string{"src dir/*.go"},
+			[]string{"echo", "src dir", "$HOME", "$", ""},
+		},
+	} {
+		flagExpandEnv = tt.expand
+		configs, err := readConfigsFromReader(strings.NewReader(in), "test input")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := configs[0]
+		if !reflect.DeepEqual(c.globs, tt.globs) {
+			t.Errorf("with expand=%t, got globs %q; want %q", tt.expand, c.globs, tt.globs)
+		}
+		if !reflect.DeepEqual(c.command, tt.command) {
+			t.Errorf("with expand=%t, got command %q; want %q", tt.expand, c.command, tt.command)
+		}
+	}
+}
+
+func TestConfirmConfigs(t *testing.T) {
+	configs := []*Config{
+		{source: "stdin, line 1", command: []string{"echo", "hello world"}},
+		{source: "stdin, line 3", command: []string{"make"}},
+	}
+	for _, tt := range []struct {
+		answer string
+		want   bool
+	}{
+		{"y\n", true},
+		{" Yes \n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+	} {
+		var buf strings.Builder
+		if got := confirmConfigs(strings.NewReader(tt.answer), &buf, configs); got != tt.want {
+			t.Errorf("confirmConfigs with answer %q: got %t; want %t", tt.answer, got, tt.want)
+		}
+		if !strings.Contains(buf.String(), "stdin, line 1: echo 'hello world'\n") {
+			t.Errorf("confirmConfigs: commands not listed in prompt:\n%s", buf.String())
+		}
+	}
+}
+
+func TestReadConfigFlagSets(t *testing.T) {
+	const in = `@common -R '^vendor/' --all
+@go @common -r '\.go$'
+
+@go -- go build
+@common -g '*.proto' -- make proto @other
+-r @go -- echo @common
+@go echo @common
+`
+	got, err := readConfigsFromReader(strings.NewReader(in), "test input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %d configs; want 4", len(got))
+	}
+	for i, want := range []struct {
+		regexes        []string
+		globs          []string
+		inverseRegexes []string
+		command        []string
+	}{
+		{[]string{`\.go$`}, nil, []string{"^vendor/"}, []string{"go", "build"}},
+		{nil, []string{"*.proto"}, []string{"^vendor/"}, []string{"make", "proto", "@other"}},
+		// Sets aren't expanded as flag values or in the command.
+		{[]string{"@go"}, nil, nil, []string{"echo", "@common"}},
+		{[]string{`\.go$`}, nil, []string{"^vendor/"}, []string{"echo", "@common"}},
+	} {
+		c := got[i]
+		if !reflect.DeepEqual(c.regexes, want.regexes) ||
+			!reflect.DeepEqual(c.globs, want.globs) ||
+			!reflect.DeepEqual(c.inverseRegexes, want.inverseRegexes) ||
+			!reflect.DeepEqual(c.command, want.command) || c.allFiles != (want.inverseRegexes != nil) {
+			t.Errorf("config %d: got %# v", i, pretty.Formatter(c))
+		}
+	}
+
+	for _, in := range []string{
+		"@common\n-- echo hi\n",
+		"@common --no-such-flag\n@common -- echo hi\n",
+		// A set may not contain a command.
+		"@common -g '*.go' -- echo hi\n",
+		"@common -g '*.go' echo hi\n",
+	} {
+		if _, err := readConfigsFromReader(strings.NewReader(in), "test input"); err == nil {
+			t.Errorf("readConfigsFromReader(%q): got nil error", in)
+		}
+	}
+}
+
+func TestReadConfigsYAML(t *testing.T) {
+	f, err := ioutil.TempFile("", "reflex-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("- command: echo hi\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	_, _, err = ReadConfigs(f.Name())
+	if err == nil || !strings.Contains(err.Error(), "YAML") {
+		t.Errorf("ReadConfigs(%q): got error %v; want one saying YAML isn't supported", f.Name(), err)
+	}
+}
+
+func TestReadJSONConfigs(t *testing.T) {
+	const in = `[
+	{"glob": "*.scss", "command": "sass {} 'out dir/'"},
+	{
+		"regex": ["\\.go$", "\\.tmpl$"],
+		"start_service": true,
+		"shutdown-timeout": "2s",
+		"command": ["./server", "--port=8080"]
+	}
+]`
+	got, err := readJSONConfigs(strings.NewReader(in), "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Config{
+		{
+			command:         []string{"sass", "{}", "out dir/"},
+			source:          "test.json, command 1",
+			globs:           []string{"*.scss"},
+			subSymbol:       "{}",
+			backlogOrder:    "any",
+			defaultIgnores:  "vcs,editor,os",
+			shutdownTimeout: 500 * time.Millisecond,
+			readyTimeout:    30 * time.Second,
+			debounce:        300 * time.Millisecond,
+			globDotfiles:    true,
+		},
+		{
+			command:         []string{"./server", "--port=8080"},
+			source:          "test.json, command 2",
+			regexes:         []string{`\.go$`, `\.tmpl$`},
+			subSymbol:       "{}",
+			backlogOrder:    "any",
+			defaultIgnores:  "vcs,editor,os",
+			startService:    true,
+			shutdownTimeout: 2 * time.Second,
+			readyTimeout:    30 * time.Second,
+			debounce:        300 * time.Millisecond,
+			globDotfiles:    true,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readJSONConfigs: got diffs:\n%s",
+			strings.Join(pretty.Diff(got, want), "\n"))
+	}
+
+	for _, in := range []string{
+		`{"command": "echo"}`,
+		`[{"glob": "*.go"}]`,
+		`[{"command": 1}]`,
+		`[{"command": ["echo", 1]}]`,
+		`[{"command": "echo 'hi"}]`,
+		`[{"no_such_flag": true, "command": "echo"}]`,
+		`[{"glob": {"a": "b"}, "command": "echo"}]`,
+	} {
+		if _, err := readJSONConfigs(strings.NewReader(in), "test.json"); err == nil {
+			t.Errorf("readJSONConfigs(%s): got nil error", in)
+		}
+	}
+}
+
+func TestReadConfigsFromEnv(t *testing.T) {
+	environ := []string{
+		"HOME=/home/me",
+		"REFLEX_1_COMMAND=./server --port=8080",
+		"REFLEX_1_START_SERVICE=true",
+		"REFLEX_1_REGEX=\\.go$",
+		"REFLEX_0_GLOB=*.scss",
+		"REFLEX_0_COMMAND=sass {} 'out dir/'",
+		"REFLEX_COMMAND=ignored",
+	}
+	got, err := readConfigsFromEnv(environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Config{
+		{
+			command:         []string{"sass", "{}", "out dir/"},
+			source:          "environment, REFLEX_0_*",
+			globs:           []string{"*.scss"},
+			subSymbol:       "{}",
+			backlogOrder:    "any",
+			defaultIgnores:  "vcs,editor,os",
+			shutdownTimeout: 500 * time.Millisecond,
+			readyTimeout:    30 * time.Second,
+			debounce:        300 * time.Millisecond,
+			globDotfiles:    true,
+		},
+		{
+			command:         []string{"./server", "--port=8080"},
+			source:          "environment, REFLEX_1_*",
+			regexes:         []string{`\.go$`},
+			subSymbol:       "{}",
+			backlogOrder:    "any",
+			defaultIgnores:  "vcs,editor,os",
+			startService:    true,
+			shutdownTimeout: 500 * time.Millisecond,
+			readyTimeout:    30 * time.Second,
+			debounce:        300 * time.Millisecond,
+			globDotfiles:    true,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readConfigsFromEnv: got diffs:\n%s",
+			strings.Join(pretty.Diff(got, want), "\n"))
+	}
+
+	for _, environ := range [][]string{
+		{"REFLEX_0_REGEX=foo"},
+		{"REFLEX_0_COMMAND=echo 'hi"},
+		{"REFLEX_0_COMMAND=echo", "REFLEX_0_NO_SUCH_FLAG=1"},
+	} {
+		if _, err := readConfigsFromEnv(environ); err == nil {
+			t.Errorf("readConfigsFromEnv(%q): got nil error", environ)
 		}
 	}
 }
@@ -1,26 +1,114 @@
 package main
 
-import "regexp"
-
-var defaultExcludes = []string{
-	// VCS dirs
-	`(^|/)\.git/`,
-	`(^|/)\.hg/`,
-	// Vim
-	`~$`,
-	`\.swp$`,
-	// Emacs
-	`\.#`,
-	`(^|/)#.*#$`,
-	// OS X
-	`(^|/)\.DS_Store$`,
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultExcludeGroups are the files that are excluded by default, in groups
+// that --default-ignores can choose between.
+var defaultExcludeGroups = []struct {
+	name     string
+	patterns []string
+}{
+	{"vcs", []string{
+		`(^|/)\.git/`,
+		`(^|/)\.hg/`,
+	}},
+	{"editor", []string{
+		// Vim
+		`~$`,
+		`\.swp$`,
+		// Emacs
+		`\.#`,
+		`(^|/)#.*#$`,
+	}},
+	{"os", []string{
+		// OS X
+		`(^|/)\.DS_Store$`,
+	}},
 }
 
+// defaultExcludes are the patterns of all the defaultExcludeGroups.
+var defaultExcludes []string
+
 var defaultExcludeMatcher multiMatcher
 
+// userExcludes are the extra patterns to exclude by default, from
+// --default-exclude and REFLEX_EXCLUDE; userExcludeMatcher excludes them.
+// Like the built-in exclusions, they don't apply with --all.
+var (
+	userExcludes       []string
+	userExcludeMatcher multiMatcher
+)
+
 func init() {
+	for _, group := range defaultExcludeGroups {
+		defaultExcludes = append(defaultExcludes, group.patterns...)
+	}
 	for _, pattern := range defaultExcludes {
 		m := newRegexMatcher(regexp.MustCompile(pattern), true)
 		defaultExcludeMatcher = append(defaultExcludeMatcher, m)
 	}
 }
+
+// defaultExcludesFor returns the patterns of the defaultExcludeGroups named
+// in groups, a comma-separated list as given to --default-ignores.
+func defaultExcludesFor(groups string) ([]string, error) {
+	var names []string
+	known := make(map[string]bool)
+	for _, group := range defaultExcludeGroups {
+		names = append(names, group.name)
+		known[group.name] = true
+	}
+	chosen := make(map[string]bool)
+	for _, name := range strings.Split(groups, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown group %q (choices: %s)", name, strings.Join(names, ", "))
+		}
+		chosen[name] = true
+	}
+	var patterns []string
+	for _, group := range defaultExcludeGroups {
+		if chosen[group.name] {
+			patterns = append(patterns, group.patterns...)
+		}
+	}
+	return patterns, nil
+}
+
+// defaultExcludeMatcherFor returns a Matcher that excludes the files in the
+// defaultExcludeGroups named in groups (see defaultExcludesFor).
+func defaultExcludeMatcherFor(groups string) (Matcher, error) {
+	patterns, err := defaultExcludesFor(groups)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == len(defaultExcludes) {
+		return defaultExcludeMatcher, nil
+	}
+	var m multiMatcher
+	for _, pattern := range patterns {
+		m = append(m, newRegexMatcher(regexp.MustCompile(pattern), true))
+	}
+	return m, nil
+}
+
+// addUserExcludes adds patterns, which are regular expressions, to
+// userExcludes.
+func addUserExcludes(patterns []string) error {
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		userExcludes = append(userExcludes, pattern)
+		userExcludeMatcher = append(userExcludeMatcher, newRegexMatcher(regex, true))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// With --command-format, the command is a printf-like template rather than
+// using {} and the other brace tokens. These are its placeholders:
+//
+//	%f  the path of the changed file (as for {})
+//	%d  the directory of the changed file
+//	%b  the base name of the changed file
+//	%e  the extension of the changed file, including the dot
+//	%n  the number of different files in the batch (as for {count})
+//	%%  a literal %
+
+// checkCommandFormat checks that command, a --command-format template, only
+// uses known placeholders. It reports whether any of them depend on the
+// changed file and whether %n is used.
+func checkCommandFormat(command []string) (perFile, count bool, err error) {
+	for _, part := range command {
+		for i := 0; i < len(part); i++ {
+			if part[i] != '%' {
+				continue
+			}
+			i++
+			if i == len(part) {
+				return false, false, fmt.Errorf("bad --command-format argument %q: trailing %%", part)
+			}
+			switch part[i] {
+			case 'f', 'd', 'b', 'e':
+				perFile = true
+			case 'n':
+				count = true
+			case '%':
+			default:
+				return false, false, fmt.Errorf("bad --command-format argument %q: unknown placeholder %%%c", part, part[i])
+			}
+		}
+	}
+	return perFile, count, nil
+}
+
+// expandCommandFormat returns command, a --command-format template that has
+// passed checkCommandFormat, with its placeholders replaced for a change to
+// name in a batch of count files. If quote is set (for --shell), the values
+// are quoted for the shell.
+func expandCommandFormat(command []string, name string, count int, quote bool) []string {
+	dir, base, ext := nameParts(name)
+	values := map[byte]string{
+		'f': name,
+		'd': dir,
+		'b': base,
+		'e': ext,
+		'n': strconv.Itoa(count),
+	}
+	if quote {
+		for verb, value := range values {
+			values[verb] = shellquote.Join(value)
+		}
+	}
+	values['%'] = "%"
+	expanded := make([]string, len(command))
+	for i, part := range command {
+		var b strings.Builder
+		for j := 0; j < len(part); j++ {
+			if part[j] == '%' && j+1 < len(part) {
+				j++
+				b.WriteString(values[part[j]])
+				continue
+			}
+			b.WriteByte(part[j])
+		}
+		expanded[i] = b.String()
+	}
+	return expanded
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandCommandFormat(t *testing.T) {
+	for _, tt := range []struct {
+		command []string
+		name    string
+		want    []string
+	}{
+		{[]string{"echo", "%f"}, "main.go", []string{"echo", "main.go"}},
+		{[]string{"%d", "%b", "%e"}, "a/b/c.tar.gz", []string{"a/b", "c.tar.gz", ".gz"}},
+		{[]string{"%d", "%b", "%e"}, "Makefile", []string{".", "Makefile", ""}},
+		{[]string{"%f", "%d", "%b"}, "a/b/", []string{"a/b/", "a", "b"}},
+		{[]string{"%%f=%f", "{}"}, "x.go", []string{"%f=x.go", "{}"}},
+		{[]string{"%n"}, "x.go", []string{"3"}},
+	} {
+		got := expandCommandFormat(tt.command, tt.name, 3, false)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandCommandFormat(%q, %q): got %q; want %q", tt.command, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCommandFormat(t *testing.T) {
+	for _, tt := range []struct {
+		command     []string
+		wantPerFile bool
+		wantCount   bool
+		wantErr     bool
+	}{
+		{[]string{"make"}, false, false, false},
+		{[]string{"echo", "%f"}, true, false, false},
+		{[]string{"echo", "%d/%b"}, true, false, false},
+		{[]string{"echo", "%n"}, false, true, false},
+		{[]string{"echo", "100%%"}, false, false, false},
+		{[]string{"echo", "%%f"}, false, false, false},
+		{[]string{"echo", "%s"}, false, false, true},
+		{[]string{"echo", "100%"}, false, false, true},
+	} {
+		perFile, count, err := checkCommandFormat(tt.command)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("checkCommandFormat(%q): got err %v; want error: %t", tt.command, err, tt.wantErr)
+			continue
+		}
+		if perFile != tt.wantPerFile || count != tt.wantCount {
+			t.Errorf("checkCommandFormat(%q): got (%t, %t); want (%t, %t)",
+				tt.command, perFile, count, tt.wantPerFile, tt.wantCount)
+		}
+	}
+}
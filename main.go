@@ -1,16 +1,25 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/kballard/go-shellquote"
 	flag "github.com/ogier/pflag"
 )
 
@@ -27,10 +36,72 @@ var (
 	globalFlags    = flag.NewFlagSet("", flag.ContinueOnError)
 	globalConfig   = &Config{}
 
+	flagSummaryInterval time.Duration
+	flagExplainWatches  bool
+	flagDryRun          bool
+	flagOnExit          string
+	onExitCommand       []string
+	flagExpandEnv       bool
+	flagMaxWatches      int
+	flagForce           bool
+	flagSafe            bool
+	flagWaitForOne      bool
+	flagDirEvents       bool
+	flagFromEnv         bool
+	flagCount           int
+	flagTerseInfo       bool
+	flagShowConfig      bool
+	flagCaseSensitive   bool
+	flagCanonicalCase   bool
+	flagFollowSymlinks  bool
+	flagGlobalDebounce  time.Duration
+	flagWatchdog        time.Duration
+	flagDedupOutput     bool
+	flagWatchDirs       []string
+	flagExcludeDirs     []string
+	flagTimestamp       string
+	flagColors          string
+	flagPropagateExit   bool
+	flagDefaultExcludes []string
+	flagQueuePaused     bool
+	timestampLayout     string
+
+	// waitedForOne is closed when the first batch of changes has been
+	// handled with --wait-for-one.
+	waitedForOne     = make(chan struct{})
+	waitedForOneOnce sync.Once
+
+	// countReached is closed when the run allowed by --count has finished.
+	countReached     = make(chan struct{})
+	countReachedOnce sync.Once
+	// runsStarted is the number of runs counted toward --count. Accessed
+	// atomically.
+	runsStarted int64
+
+	// lastExitStatus is the exit status of the last command (other than
+	// a service) to finish, for --propagate-exit. Accessed atomically.
+	lastExitStatus int64
+
+	// lastChange is when broadcast last passed on a change, in Unix
+	// nanoseconds, for --global-debounce. Accessed atomically.
+	lastChange int64
+
+	// reflexesMu protects reflexes and reflexChanges (the channel that
+	// broadcast sends changes to for each reflex). Both are replaced when
+	// the config file is reloaded.
+	reflexesMu    sync.Mutex
+	reflexChanges []chan string
+
 	reflexID = 0
 	stdout   = make(chan OutMsg, 1)
 
 	cleanupMu = &sync.Mutex{}
+
+	// Counters reported (and reset) by the --summary-interval heartbeat.
+	// Accessed atomically.
+	eventsReceived int64
+	eventsMatched  int64
+	commandsRun    int64
 )
 
 func usage() {
@@ -70,23 +141,201 @@ func init() {
 	globalFlags.BoolVarP(&flagSequential, "sequential", "e", false, `
             Don't run multiple commands at the same time.`)
 	globalFlags.StringVarP(&flagDecoration, "decoration", "d", "plain", `
-            How to decorate command output. Choices: none, plain, fancy.`)
+            How to decorate command output. Choices: none, plain, fancy,
+            json (one JSON object per line).`)
+	globalFlags.DurationVar(&flagSummaryInterval, "summary-interval", 0, `
+            In verbose mode, periodically print a summary of the events
+            seen and commands run. (0 disables the summary.)`)
+	globalFlags.BoolVar(&flagExplainWatches, "explain-watches", false, `
+            Print which directories would be watched or skipped (and
+            why), then exit without running any commands.`)
+	globalFlags.BoolVar(&flagDryRun, "dry-run", false, `
+            Instead of running commands, print each change and, for
+            every command, whether it matches (and what would run) or
+            which pattern rejects it.`)
+	globalFlags.StringVar(&flagOnExit, "on-exit", "", `
+            A command to run when reflex exits, after stopping the
+            running commands. It is split into arguments like a
+            config file line and killed after 10s.`)
+	globalFlags.BoolVar(&flagExpandEnv, "expand-env", false, `
+            Expand environment variables ($VAR or ${VAR}) in config
+            file lines. Use $$ for a literal $.`)
+	globalFlags.IntVar(&flagMaxWatches, "max-watches", 100000, `
+            The maximum number of directories to watch when reflex
+            starts. Reflex exits with an error rather than watch more.
+            (0 means no limit.)`)
+	globalFlags.BoolVar(&flagForce, "force", false, `
+            Run even if the current directory is your home directory
+            or the filesystem root.`)
+	globalFlags.BoolVar(&flagSafe, "safe", false, `
+            Print the commands from the --config file (or --from-env)
+            and ask for confirmation (on the terminal) before running
+            them.`)
+	globalFlags.BoolVar(&flagWaitForOne, "wait-for-one", false, `
+            Exit after the first matching change (and after running the
+            command once, if one is given).`)
+	globalFlags.BoolVar(&flagDirEvents, "dir-events", true, `
+            Pass on changes to directories themselves (such as a file
+            being added to a directory), not only changes to files.`)
+	globalFlags.BoolVar(&flagFromEnv, "from-env", false, `
+            Read the configuration from REFLEX_<N>_COMMAND and
+            REFLEX_<N>_<FLAG> environment variables instead of a file.`)
+	globalFlags.IntVar(&flagCount, "count", 0, `
+            Exit after running commands this many times in total
+            (across all commands; services are not counted). (0 means
+            no limit.)`)
+	globalFlags.BoolVar(&flagPropagateExit, "propagate-exit", false, `
+            Exit with the exit status of the last command that ran
+            (services aside) rather than 0.`)
+	globalFlags.BoolVar(&flagTerseInfo, "terse-info", false, `
+            Shorten the messages about starting, stopping, and
+            signaling commands (for example, "~ start" instead of
+            "Starting service").`)
+	globalFlags.BoolVar(&flagShowConfig, "show-config", false, `
+            Before watching, print the effective configuration of each
+            command (with the default exclusions spelled out) as config
+            file lines.`)
+	globalFlags.BoolVar(&flagCaseSensitive, "case-sensitive", true, `
+            Match patterns against paths exactly, byte for byte. False
+            is like --ignore-case for every command.`)
+	globalFlags.BoolVar(&flagCanonicalCase, "canonicalize-case", false, `
+            Before matching, correct the case of each changed path to
+            match the names on disk (for case-insensitive filesystems
+            that may report a path in a different case).`)
+	globalFlags.BoolVar(&flagFollowSymlinks, "follow-symlinks", false, `
+            Watch the directories that symlinks in the watched
+            directory point to (each directory is watched only once,
+            so links that form a loop are fine).`)
+	globalFlags.DurationVar(&flagGlobalDebounce, "global-debounce", 0, `
+            Wait until no file has changed for this long before running
+            any command, so that all the commands triggered by a burst
+            of changes run together. Overrides --debounce,
+            --flush-first, and --debounce-per-file. (0 means each
+            command debounces on its own.)`)
+	globalFlags.DurationVar(&flagWatchdog, "watchdog", 0, `
+            Check this often that file events are still arriving (by
+            creating a temporary file in each watch root: the current
+            directory and any --watch-dir), and rebuild the watcher if
+            they aren't. (0 disables the check.)`)
+	globalFlags.BoolVar(&flagDedupOutput, "dedup-output", false, `
+            Collapse runs of identical output lines from a command
+            into a single line marked with the number of repeats, like
+            "(x12)". Each line is printed once the run ends.`)
+	globalFlags.Var(newMultiString(nil, &flagWatchDirs), "watch-dir", `
+            Another directory to watch, besides the current one. The
+            names of the files in it are matched and substituted with
+            the directory in front, as given. (May be repeated.)`)
+	globalFlags.Var(newMultiString(nil, &flagExcludeDirs), "exclude-dir", `
+            A shell glob for directories not to watch at all (such as
+            node_modules), matched against each directory's name or,
+            if it contains a /, its path. (May be repeated.)`)
+	globalFlags.StringVar(&flagTimestamp, "timestamp", "", `
+            Prefix each line of output with the time it was printed,
+            in this Go time layout (like 15:04:05.000) or rfc3339.
+            Ignored with --decoration=json, which always has the time.`)
+	globalFlags.StringVar(&flagColors, "colors", "", `
+            The colors to give the commands' output with
+            --decoration=fancy, in turn, separated by commas: ANSI
+            codes (30-37 and 90-97) or names like red, cyan, and
+            bright-blue. (The default is green through cyan.)`)
+	globalFlags.Var(newMultiString(nil, &flagDefaultExcludes), "default-exclude", `
+            A regular expression for files that every command ignores,
+            along with the built-in ones (unless it has --all). (May be
+            repeated; more can be given in $REFLEX_EXCLUDE, separated
+            by spaces.)`)
+	globalFlags.BoolVar(&flagQueuePaused, "queue-while-paused", false, `
+            While reflex is paused (with SIGUSR2), hold on to the
+            changes that happen and run them when it resumes, instead
+            of ignoring them.`)
 	globalConfig.registerFlags(globalFlags)
 }
 
+// globalOnlyFlags are the flags that apply to reflex as a whole rather than to
+// a particular command; they may be combined with --config.
+var globalOnlyFlags = []string{
+	"config",
+	"verbose",
+	"sequential",
+	"decoration",
+	"summary-interval",
+	"explain-watches",
+	"dry-run",
+	"on-exit",
+	"expand-env",
+	"max-watches",
+	"force",
+	"safe",
+	"wait-for-one",
+	"dir-events",
+	"from-env",
+	"count",
+	"propagate-exit",
+	"terse-info",
+	"show-config",
+	"case-sensitive",
+	"canonicalize-case",
+	"follow-symlinks",
+	"global-debounce",
+	"watchdog",
+	"dedup-output",
+	"watch-dir",
+	"exclude-dir",
+	"timestamp",
+	"colors",
+	"default-exclude",
+	"queue-while-paused",
+}
+
 func anyNonGlobalsRegistered() bool {
 	any := false
 	walkFn := func(f *flag.Flag) {
-		switch f.Name {
-		case "config", "verbose", "sequential", "decoration":
-		default:
-			any = true
+		for _, name := range globalOnlyFlags {
+			if f.Name == name {
+				return
+			}
 		}
+		any = true
 	}
 	globalFlags.Visit(walkFn)
 	return any
 }
 
+// applyConfigGlobals sets the global flags given by the !global lines of a
+// config file (args). A flag can't be set both there and on the command line,
+// nor can the flags that affect reading the config file be set there.
+func applyConfigGlobals(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	fs := flag.NewFlagSet(globalDirective, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	for _, name := range globalOnlyFlags {
+		switch name {
+		case "config", "from-env", "expand-env":
+			// These affect how the config file itself is read.
+			continue
+		}
+		// The flags share their values with globalFlags.
+		f := globalFlags.Lookup(name)
+		fs.VarP(f.Value, f.Name, f.Shorthand, f.Usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	onCommandLine := make(map[string]bool)
+	globalFlags.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil && onCommandLine[f.Name] {
+			err = fmt.Errorf("--%s is also set on the command line", f.Name)
+		}
+	})
+	return err
+}
+
 func printGlobals() {
 	fmt.Println("Globals set at commandline")
 	walkFn := func(f *flag.Flag) {
@@ -97,11 +346,59 @@ func printGlobals() {
 	fmt.Println("+---------")
 }
 
+// showConfig writes the effective configuration to w, for --show-config: the
+// global flags, as a comment, and then a config file line for each reflex
+// (made from the corresponding element of configs).
+func showConfig(w io.Writer, configs []*Config, reflexes []*Reflex) {
+	var globals []string
+	globalFlags.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "from-env", "show-config":
+			return
+		}
+		for _, name := range globalOnlyFlags {
+			if f.Name == name {
+				globals = append(globals, "--"+f.Name+"="+f.Value.String())
+			}
+		}
+	})
+	fmt.Fprintf(w, "# Global flags: %s\n", joinArgs(globals))
+	for i, r := range reflexes {
+		c := configs[i]
+		backlog := "one run per batch"
+		switch r.backlog.(type) {
+		case *UniqueFilesBacklog:
+			backlog = "one run per file"
+		case *OrderedFilesBacklog:
+			backlog = "one run per file, in order"
+		case *LatestBacklog:
+			backlog = "one run per batch, for the latest file"
+		}
+		fmt.Fprintf(w, "\n# [%02d] from %s; %s; shutdown timeout %s\n", r.id, c.source, backlog, r.timeout)
+		var args []string
+		if !c.allFiles {
+			// Spell out the default exclusions.
+			args = append(args, "--all")
+			patterns, _ := defaultExcludesFor(c.defaultIgnores)
+			patterns = append(patterns, userExcludes...)
+			for _, pattern := range patterns {
+				args = append(args, "--inverse-regex="+pattern)
+			}
+		}
+		args = append(args, c.flagArgs()...)
+		args = append(args, "--")
+		args = append(args, c.command...)
+		fmt.Fprintln(w, joinArgs(args))
+	}
+}
+
 func cleanup(reason string) {
 	cleanupMu.Lock()
-	fmt.Println(reason)
+	if reason != "" {
+		directPrintln(reason)
+	}
 	wg := &sync.WaitGroup{}
-	for _, reflex := range reflexes {
+	for _, reflex := range currentReflexes() {
 		if reflex.Running() {
 			wg.Add(1)
 			go func(reflex *Reflex) {
@@ -111,9 +408,74 @@ func cleanup(reason string) {
 		}
 	}
 	wg.Wait()
+	runOnExit()
+	if watchdogSentinel != "" {
+		for _, root := range append([]string{"."}, flagWatchDirs...) {
+			os.Remove(filepath.Join(root, watchdogSentinel))
+		}
+	}
 	// Give just a little time to finish printing output.
 	time.Sleep(10 * time.Millisecond)
-	os.Exit(0)
+	status := 0
+	if flagPropagateExit {
+		status = int(atomic.LoadInt64(&lastExitStatus))
+	}
+	os.Exit(status)
+}
+
+const onExitTimeout = 10 * time.Second
+
+// runOnExit runs the --on-exit command, if any (and not with --dry-run),
+// passing its output to the stdout channel. The command is killed if it runs
+// for longer than onExitTimeout.
+func runOnExit() {
+	if len(onExitCommand) == 0 || flagDryRun {
+		return
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		infoPrintln(-1, "Error running --on-exit command:", err)
+		return
+	}
+	defer pr.Close()
+	cmd := exec.Command(onExitCommand[0], onExitCommand[1:]...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		infoPrintln(-1, "Error running --on-exit command:", err)
+		return
+	}
+
+	scanned := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			infoPrintln(-1, scanner.Text())
+		}
+		close(scanned)
+	}()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	timer := time.NewTimer(onExitTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-exited:
+	case <-timer.C:
+		cmd.Process.Kill()
+		infoPrintf(-1, "--on-exit command did not finish after %s; killed it", onExitTimeout)
+		return
+	}
+	// Let the output finish printing before reporting errors.
+	select {
+	case <-scanned:
+	case <-timer.C:
+	}
+	if err != nil {
+		infoPrintln(-1, "Error running --on-exit command:", err)
+	}
 }
 
 func main() {
@@ -123,38 +485,114 @@ func main() {
 	}
 	globalConfig.command = globalFlags.Args()
 	globalConfig.source = "[commandline]"
-	if verbose {
-		printGlobals()
-	}
-	switch strings.ToLower(flagDecoration) {
-	case "none":
-		decoration = DecorationNone
-	case "plain":
-		decoration = DecorationPlain
-	case "fancy":
-		decoration = DecorationFancy
-	default:
-		log.Fatalf("Invalid decoration %s. Choices: none, plain, fancy.", flagDecoration)
-	}
 
+	// Read the config file first, since it may set more global flags.
 	var configs []*Config
-	if flagConf == "" {
+	if flagConf == "" && !flagFromEnv {
 		if flagSequential {
 			log.Fatal("Cannot set --sequential without --config (because you cannot specify multiple commands).")
 		}
+		if flagSafe {
+			log.Fatal("Cannot set --safe without --config or --from-env.")
+		}
 		configs = []*Config{globalConfig}
 	} else {
+		source := "--config"
+		if flagFromEnv {
+			source = "--from-env"
+		}
+		if flagConf != "" && flagFromEnv {
+			log.Fatal("Cannot set both --config and --from-env.")
+		}
 		if anyNonGlobalsRegistered() {
-			log.Fatal("Cannot set other flags along with --config other than --sequential, --verbose, and --decoration.")
+			var allowed []string
+			for _, name := range globalOnlyFlags {
+				if name != "config" && name != "from-env" {
+					allowed = append(allowed, "--"+name)
+				}
+			}
+			log.Fatalf("Cannot set other flags along with %s other than %s.", source, strings.Join(allowed, ", "))
 		}
+		var globals []string
 		var err error
-		configs, err = ReadConfigs(flagConf)
+		if flagFromEnv {
+			configs, err = readConfigsFromEnv(os.Environ())
+		} else {
+			configs, globals, err = ReadConfigs(flagConf)
+		}
 		if err != nil {
 			log.Fatalln("Could not parse configs:", err)
 		}
+		if err := applyConfigGlobals(globals); err != nil {
+			log.Fatalf("Bad %s line in %s: %s", globalDirective, flagConf, err)
+		}
 		if len(configs) == 0 {
 			log.Fatal("No configurations found")
 		}
+		if flagSafe {
+			// Stdin may be the config itself, so ask on the terminal.
+			tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+			if err != nil {
+				log.Fatalln("Cannot ask for confirmation (--safe):", err)
+			}
+			ok := confirmConfigs(tty, tty, configs)
+			tty.Close()
+			if !ok {
+				log.Fatal("Not running the commands.")
+			}
+		}
+	}
+	if verbose {
+		printGlobals()
+	}
+	switch strings.ToLower(flagDecoration) {
+	case "none":
+		decoration = DecorationNone
+	case "plain":
+		decoration = DecorationPlain
+	case "fancy":
+		decoration = DecorationFancy
+	case "json":
+		decoration = DecorationJSON
+	default:
+		log.Fatalf("Invalid decoration %s. Choices: none, plain, fancy, json.", flagDecoration)
+	}
+	if flagColors != "" {
+		colors, err := parseColors(flagColors)
+		if err != nil {
+			log.Fatalln("Bad --colors:", err)
+		}
+		fancyColors = colors
+	}
+	timestampLayout = flagTimestamp
+	if strings.EqualFold(flagTimestamp, "rfc3339") {
+		timestampLayout = time.RFC3339
+	}
+	if flagSummaryInterval < 0 {
+		log.Fatal("--summary-interval cannot be negative.")
+	}
+	if flagSummaryInterval > 0 && !verbose {
+		log.Fatal("Cannot set --summary-interval without --verbose.")
+	}
+	if flagMaxWatches < 0 {
+		log.Fatal("--max-watches cannot be negative.")
+	}
+	if flagGlobalDebounce < 0 {
+		log.Fatal("--global-debounce cannot be negative.")
+	}
+	if flagWatchdog < 0 {
+		log.Fatal("--watchdog cannot be negative.")
+	}
+	excludes := append(flagDefaultExcludes, strings.Fields(os.Getenv("REFLEX_EXCLUDE"))...)
+	if err := addUserExcludes(excludes); err != nil {
+		log.Fatalln("Bad --default-exclude or REFLEX_EXCLUDE pattern:", err)
+	}
+	if flagOnExit != "" {
+		var err error
+		onExitCommand, err = shellquote.Split(flagOnExit)
+		if err != nil {
+			log.Fatalln("Could not parse --on-exit command:", err)
+		}
 	}
 
 	for _, config := range configs {
@@ -167,6 +605,41 @@ func main() {
 		}
 		reflexes = append(reflexes, reflex)
 	}
+	if err := checkNames(reflexes); err != nil {
+		log.Fatal(err)
+	}
+
+	if flagShowConfig {
+		showConfig(os.Stdout, configs, reflexes)
+	}
+
+	for _, pattern := range flagExcludeDirs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Bad --exclude-dir %q: %s", pattern, err)
+		}
+	}
+
+	roots := append([]string{"."}, flagWatchDirs...)
+	for _, root := range flagWatchDirs {
+		watchDirs[root] = true
+	}
+
+	if flagExplainWatches {
+		for _, root := range roots {
+			if err := explainWatches(os.Stdout, root, reflexes); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+
+	if !flagForce {
+		for _, root := range roots {
+			if err := checkWatchRoot(root); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
 	// Catch ctrl-c and make sure to kill off children.
 	signals := make(chan os.Signal, 1)
@@ -175,10 +648,28 @@ func main() {
 	go func() {
 		s := <-signals
 		reason := fmt.Sprintf("Interrupted (%s). Cleaning up children...", s)
-		cleanup(reason)
+		go cleanup(reason)
+		// If children are slow to die, a second signal kills them
+		// outright and exits immediately.
+		s = <-signals
+		directPrintln(fmt.Sprintf("Interrupted again (%s). Killing children and exiting.", s))
+		for _, reflex := range currentReflexes() {
+			reflex.forceKill()
+		}
+		os.Exit(1)
 	}()
 	defer cleanup("Cleaning up.")
 
+	// Dump debugging information on SIGQUIT (ctrl-\) rather than exiting.
+	// Commands run in their own sessions, so they don't get the signal.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+	go func() {
+		for range quit {
+			dumpState(os.Stderr)
+		}
+	}()
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatal(err)
@@ -186,26 +677,239 @@ func main() {
 	defer watcher.Close()
 
 	changes := make(chan string)
-	broadcastChanges := make([]chan string, len(reflexes))
+	reflexChanges = make([]chan string, len(reflexes))
 	done := make(chan error)
 	for i := range reflexes {
-		broadcastChanges[i] = make(chan string)
+		reflexChanges[i] = make(chan string)
+	}
+	if flagWatchdog > 0 {
+		watchdogSentinel = fmt.Sprintf(".reflex-watchdog-%d", os.Getpid())
+		go superviseWatch(".", changes, done, currentReflexes)
+	} else {
+		go watch(".", watcher, changes, done, currentReflexes)
+	}
+	// Each extra root gets a watcher of its own.
+	for _, root := range flagWatchDirs {
+		if flagWatchdog > 0 {
+			go superviseWatch(root, changes, done, currentReflexes)
+			continue
+		}
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer watcher.Close()
+		go watch(root, watcher, changes, done, currentReflexes)
 	}
-	go watch(".", watcher, changes, done, reflexes)
-	go broadcast(broadcastChanges, changes)
+	// A trigger signal (SIGUSR1) runs every command as though a file had
+	// changed, without having to touch one.
+	if len(triggerSignals) > 0 {
+		trigger := make(chan os.Signal, 1)
+		signal.Notify(trigger, triggerSignals...)
+		go func() {
+			for s := range trigger {
+				infoPrintf(-1, "Received %s; running the commands.", signalName(s.(syscall.Signal)))
+				changes <- ""
+			}
+		}()
+	}
+	// A pause signal (SIGUSR2) stops reflex from reacting to changes, as
+	// during a rebase, until it's sent again.
+	if len(pauseSignals) > 0 {
+		pauses := make(chan os.Signal, 1)
+		signal.Notify(pauses, pauseSignals...)
+		go func() {
+			for s := range pauses {
+				name := signalName(s.(syscall.Signal))
+				paused, held := togglePause()
+				if paused {
+					infoPrintf(-1, "Received %s; paused. Send it again to resume.", name)
+					continue
+				}
+				infoPrintf(-1, "Received %s; resumed (%d changes held).", name, len(held))
+				for _, change := range held {
+					changes <- change
+				}
+			}
+		}()
+	}
+	go broadcast(currentChanges, changes)
 	go printOutput(stdout, os.Stdout)
 
 	for i, reflex := range reflexes {
-		reflex.Start(broadcastChanges[i])
+		reflex.Start(reflexChanges[i])
+	}
+	// A config file is reloaded when it changes (unless the commands had
+	// to be confirmed with --safe).
+	if flagConf != "" && flagConf != "-" && !flagSafe {
+		go pollConfig(flagConf)
+	}
+
+	var heartbeat <-chan time.Time
+	if flagSummaryInterval > 0 {
+		ticker := time.NewTicker(flagSummaryInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case err := <-done:
+			log.Fatal(err)
+		case <-waitedForOne:
+			cleanup("")
+		case <-countReached:
+			cleanup("")
+		case <-heartbeat:
+			printSummary()
+		}
+	}
+}
+
+// dumpState writes the stacks of all goroutines and the state of each reflex
+// to w. It writes directly rather than through the stdout channel so that it
+// works even if output is stuck.
+func dumpState(w io.Writer) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	fmt.Fprintf(w, "=== Goroutines ===\n%s\n=== Reflexes ===\n", buf)
+	for _, reflex := range currentReflexes() {
+		fmt.Fprintf(w, "[%02d] running=%t killed=%t backlog=%d (%s)\n",
+			reflex.id, reflex.Running(), reflex.Killed(),
+			atomic.LoadInt64(&reflex.backlogLen), reflex.source)
 	}
+}
 
-	log.Fatal(<-done)
+// checkWatchRoot returns an error if root is too broad a directory to watch
+// recursively: the user's home directory or the filesystem root.
+func checkWatchRoot(root string) error {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	home, _ := os.UserHomeDir()
+	if !isBroadRoot(abs, home) {
+		return nil
+	}
+	return fmt.Errorf("Refusing to watch %s and all of its subdirectories. "+
+		"Run reflex in a more specific directory or pass --force to run anyway.", abs)
 }
 
-func broadcast(outs []chan string, in <-chan string) {
+// isBroadRoot reports whether the absolute path dir is the filesystem root or
+// the home directory home (which may be empty if unknown).
+func isBroadRoot(dir, home string) bool {
+	dir = filepath.Clean(dir)
+	if filepath.Dir(dir) == dir {
+		return true
+	}
+	if home == "" {
+		return false
+	}
+	home = filepath.Clean(home)
+	if dir == home {
+		return true
+	}
+	// Compare resolved paths in case either is a symlink.
+	d, err1 := filepath.EvalSymlinks(dir)
+	h, err2 := filepath.EvalSymlinks(home)
+	return err1 == nil && err2 == nil && d == h
+}
+
+// printSummary prints the counts of events and commands since the last
+// summary.
+func printSummary() {
+	infoPrintf(-1, "Summary for the last %s: %d events received, %d matched, %d commands run",
+		flagSummaryInterval,
+		atomic.SwapInt64(&eventsReceived, 0),
+		atomic.SwapInt64(&eventsMatched, 0),
+		atomic.SwapInt64(&commandsRun, 0))
+}
+
+// pause is the state toggled by a pause signal (SIGUSR2).
+var pause struct {
+	sync.Mutex
+	paused bool
+	held   []string // changes seen while paused, for --queue-while-paused
+	isHeld map[string]bool
+}
+
+// togglePause pauses reflex or resumes it, and reports whether it is now
+// paused. On resuming, it returns the changes held while it was paused.
+func togglePause() (paused bool, held []string) {
+	pause.Lock()
+	defer pause.Unlock()
+	pause.paused = !pause.paused
+	if pause.paused {
+		return true, nil
+	}
+	held = pause.held
+	pause.held = nil
+	pause.isHeld = nil
+	return false, held
+}
+
+// holdIfPaused reports whether change should be kept from the commands
+// because reflex is paused. With --queue-while-paused, the change is held
+// (once, however often it happens) until reflex resumes; otherwise it is
+// dropped. A manual trigger (an empty name) is never kept back.
+func holdIfPaused(change string) bool {
+	pause.Lock()
+	defer pause.Unlock()
+	if !pause.paused || change == "" {
+		return false
+	}
+	if flagQueuePaused && !pause.isHeld[change] {
+		if pause.isHeld == nil {
+			pause.isHeld = make(map[string]bool)
+		}
+		pause.isHeld[change] = true
+		pause.held = append(pause.held, change)
+	}
+	return true
+}
+
+// broadcastMu is held by broadcast while it passes on a change, so that
+// reloadConfig can close the channels of the reflexes it replaces.
+var broadcastMu sync.Mutex
+
+// broadcast sends each change from in to every one of the channels returned
+// by outs (which is called again for each change), unless the corresponding
+// reflex has been retired. Changes are held back while reflex is paused.
+func broadcast(outs func() ([]*Reflex, []chan string), in <-chan string) {
 	for e := range in {
-		for _, out := range outs {
-			out <- e
+		if holdIfPaused(e) {
+			continue
+		}
+		atomic.StoreInt64(&lastChange, time.Now().UnixNano())
+		broadcastMu.Lock()
+		rs, chans := outs()
+		for i, out := range chans {
+			select {
+			case out <- e:
+			case <-rs[i].retired:
+			}
 		}
+		broadcastMu.Unlock()
 	}
 }
+
+// currentReflexes returns the reflexes that are running now.
+func currentReflexes() []*Reflex {
+	reflexesMu.Lock()
+	defer reflexesMu.Unlock()
+	return reflexes
+}
+
+// currentChanges returns the reflexes that are running now along with the
+// channels that broadcast sends changes to, one for each of them.
+func currentChanges() ([]*Reflex, []chan string) {
+	reflexesMu.Lock()
+	defer reflexesMu.Unlock()
+	return reflexes, reflexChanges
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsBroadRoot(t *testing.T) {
+	for _, tt := range []struct {
+		dir  string
+		home string
+		want bool
+	}{
+		{"/", "/home/alice", true},
+		{"/home/alice", "/home/alice", true},
+		{"/home/alice/", "/home/alice", true},
+		{"/home/alice", "/home/alice/", true},
+		{"/home/alice/src/proj", "/home/alice", false},
+		{"/home", "/home/alice", false},
+		{"/home/alice", "", false},
+	} {
+		if got := isBroadRoot(tt.dir, tt.home); got != tt.want {
+			t.Errorf("isBroadRoot(%q, %q): got %t; want %t", tt.dir, tt.home, got, tt.want)
+		}
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	defer func(rs []*Reflex) { reflexes = rs }(reflexes)
+	reflexes = []*Reflex{newTestReflex(t, "--", "true")}
+	reflexes[0].backlogLen = 3
+
+	var buf strings.Builder
+	dumpState(&buf)
+	got := buf.String()
+	for _, want := range []string{
+		"goroutine ",
+		"TestDumpState",
+		"running=false killed=false backlog=3 (test)",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("dumpState output does not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestPause(t *testing.T) {
+	defer func(queue bool) { flagQueuePaused = queue }(flagQueuePaused)
+	for _, queue := range []bool{false, true} {
+		flagQueuePaused = queue
+		if holdIfPaused("a.go") {
+			t.Fatal("holdIfPaused before pausing: got true")
+		}
+		if paused, _ := togglePause(); !paused {
+			t.Fatal("togglePause: not paused")
+		}
+		for _, change := range []string{"a.go", "b.go", "a.go"} {
+			if !holdIfPaused(change) {
+				t.Errorf("holdIfPaused(%q) while paused: got false", change)
+			}
+		}
+		if holdIfPaused("") {
+			t.Error("holdIfPaused for a manual trigger: got true")
+		}
+		paused, held := togglePause()
+		if paused {
+			t.Fatal("togglePause: still paused")
+		}
+		var want []string
+		if queue {
+			want = []string{"a.go", "b.go"}
+		}
+		if !reflect.DeepEqual(held, want) {
+			t.Errorf("held changes with --queue-while-paused=%t: got %q; want %q", queue, held, want)
+		}
+	}
+}
+
+func TestApplyConfigGlobals(t *testing.T) {
+	defer func(decoration string, sequential bool) {
+		flagDecoration, flagSequential = decoration, sequential
+	}(flagDecoration, flagSequential)
+
+	if err := applyConfigGlobals([]string{"-e", "--decoration=fancy"}); err != nil {
+		t.Fatal(err)
+	}
+	if !flagSequential || flagDecoration != "fancy" {
+		t.Errorf("after applyConfigGlobals: got --sequential=%t --decoration=%s", flagSequential, flagDecoration)
+	}
+	for _, args := range [][]string{
+		{"--expand-env"},
+		{"--config=other.conf"},
+		{"-r", `\.go$`},
+		{"--sequential", "echo"},
+	} {
+		if err := applyConfigGlobals(args); err == nil {
+			t.Errorf("applyConfigGlobals(%q): got nil error", args)
+		}
+	}
+}
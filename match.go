@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"regexp/syntax"
@@ -16,44 +19,153 @@ type Matcher interface {
 	// ExcludePrefix returns whether all paths with this prefix cannot match.
 	// It is allowed to return false negatives but not false positives.
 	// This is used as an optimization for skipping directory watches with
-	// inverted matches.
+	// inverted matches (or globs that can't match anything inside).
 	ExcludePrefix(prefix string) bool
 	String() string
 }
 
+// matchOptions holds settings that change how patterns match. The zero value
+// gives the default behavior.
+type matchOptions struct {
+	// skipDotfiles makes glob wildcards not match a leading . in a path
+	// element, as in a shell.
+	skipDotfiles bool
+	// basename makes globs without a / match just the last element of a
+	// path rather than the whole thing.
+	basename bool
+	// ignoreCase makes regexes and globs match regardless of case.
+	ignoreCase bool
+}
+
 // ParseMatchers combines multiple (possibly inverse) regex and glob patterns
 // into a single Matcher.
-func ParseMatchers(regexes, inverseRegexes, globs, inverseGlobs []string) (m Matcher, err error) {
+func ParseMatchers(regexes, inverseRegexes, globs, inverseGlobs []string, opts matchOptions) (m Matcher, err error) {
 	var matchers multiMatcher
 	if len(regexes) == 0 && len(globs) == 0 {
 		matchers = multiMatcher{matchAll{}}
 	}
+	compile := regexp.Compile
+	if opts.ignoreCase {
+		compile = func(r string) (*regexp.Regexp, error) {
+			return regexp.Compile("(?i)" + r)
+		}
+	}
 	for _, r := range regexes {
-		regex, err := regexp.Compile(r)
+		regex, err := compile(r)
 		if err != nil {
 			return nil, err
 		}
 		matchers = append(matchers, newRegexMatcher(regex, false))
 	}
 	for _, r := range inverseRegexes {
-		regex, err := regexp.Compile(r)
+		regex, err := compile(r)
 		if err != nil {
 			return nil, err
 		}
 		matchers = append(matchers, newRegexMatcher(regex, true))
 	}
 	for _, g := range globs {
-		matchers = append(matchers, &globMatcher{glob: g})
+		matchers = append(matchers, newGlobMatcher(g, false, opts))
 	}
 	for _, g := range inverseGlobs {
-		matchers = append(matchers, &globMatcher{
-			glob:    g,
-			inverse: true,
-		})
+		matchers = append(matchers, newGlobMatcher(g, true, opts))
 	}
 	return matchers, nil
 }
 
+// A submatcher is a Matcher that can report which parts of a name were
+// matched by its wildcards (for globs) or capture groups (for regexes).
+type submatcher interface {
+	// Submatches returns the submatches of name, or nil if name does not
+	// match.
+	Submatches(name string) []string
+}
+
+// submatches returns the submatches of name according to the first matcher
+// within m that reports any.
+func submatches(m Matcher, name string) []string {
+	switch m := m.(type) {
+	case multiMatcher:
+		for _, matcher := range m {
+			if s := submatches(matcher, name); len(s) > 0 {
+				return s
+			}
+		}
+	case submatcher:
+		return m.Submatches(name)
+	}
+	return nil
+}
+
+// groupSubmatches is like submatches, but only regexes' capture groups count
+// (for the {N} tokens); the wildcards of globs are skipped.
+func groupSubmatches(m Matcher, name string) []string {
+	switch m := m.(type) {
+	case multiMatcher:
+		for _, matcher := range m {
+			if s := groupSubmatches(matcher, name); len(s) > 0 {
+				return s
+			}
+		}
+	case *regexMatcher:
+		return m.Submatches(name)
+	}
+	return nil
+}
+
+// captureGroups returns the largest number of capture groups of any
+// non-inverted regex within m.
+func captureGroups(m Matcher) int {
+	n := 0
+	switch m := m.(type) {
+	case multiMatcher:
+		for _, matcher := range m {
+			if groups := captureGroups(matcher); groups > n {
+				n = groups
+			}
+		}
+	case *regexMatcher:
+		if !m.inverse {
+			n = m.regex.NumSubexp()
+		}
+	}
+	return n
+}
+
+// excludedBy returns the matcher within m that causes m.ExcludePrefix(prefix)
+// to be true, or nil if m does not exclude prefix.
+func excludedBy(m Matcher, prefix string) Matcher {
+	if multi, ok := m.(multiMatcher); ok {
+		for _, matcher := range multi {
+			if excluder := excludedBy(matcher, prefix); excluder != nil {
+				return excluder
+			}
+		}
+		return nil
+	}
+	if m.ExcludePrefix(prefix) {
+		return m
+	}
+	return nil
+}
+
+// rejectedBy returns the matcher within m that causes m.Match(name) to be
+// false, or nil if m matches name.
+func rejectedBy(m Matcher, name string) Matcher {
+	if multi, ok := m.(multiMatcher); ok {
+		for _, matcher := range multi {
+			if rejecter := rejectedBy(matcher, name); rejecter != nil {
+				return rejecter
+			}
+		}
+		return nil
+	}
+	if !m.Match(name) {
+		return m
+	}
+	return nil
+}
+
 // matchAll is an all-accepting Matcher.
 type matchAll struct{}
 
@@ -62,26 +174,331 @@ func (matchAll) ExcludePrefix(prefix string) bool { return false }
 func (matchAll) String() string                   { return "(Implicitly matching all non-excluded files)" }
 
 type globMatcher struct {
-	glob    string
-	inverse bool
+	glob         string
+	inverse      bool
+	skipDotfiles bool // wildcards don't match a leading . (see matchOptions)
+	basename     bool // glob is matched against the last path element only
+
+	// alternatives are the globs that glob expands to, if it has braces
+	// (see expandBraces); a name matches if it matches any of them.
+	alternatives []string
+	// recursive holds a regexp for each of the globs (as returned by
+	// globs) that has a ** element, which filepath.Match can't handle.
+	recursive map[string]*regexp.Regexp
+	// ignoreCase means that the globs (but not glob) are lower case and
+	// are matched against lower-cased names.
+	ignoreCase bool
+}
+
+func newGlobMatcher(glob string, inverse bool, opts matchOptions) *globMatcher {
+	m := &globMatcher{
+		glob:         glob,
+		inverse:      inverse,
+		skipDotfiles: opts.skipDotfiles,
+		basename:     opts.basename && !strings.Contains(glob, "/"),
+	}
+	if alts := expandBraces(glob); len(alts) > 1 || alts[0] != glob {
+		m.alternatives = alts
+	}
+	if opts.ignoreCase {
+		m.ignoreCase = true
+		m.alternatives = nil
+		for _, g := range expandBraces(glob) {
+			m.alternatives = append(m.alternatives, strings.ToLower(g))
+		}
+	}
+	for _, g := range m.globs() {
+		if !hasDoubleStar(g) {
+			continue
+		}
+		if m.recursive == nil {
+			m.recursive = make(map[string]*regexp.Regexp)
+		}
+		if regex, err := regexp.Compile(globToRegexp(g)); err == nil {
+			m.recursive[g] = regex
+		}
+	}
+	return m
+}
+
+// hasDoubleStar reports whether glob has a ** path element, which matches
+// any number of directories (including none).
+func hasDoubleStar(glob string) bool {
+	for _, elem := range strings.Split(glob, "/") {
+		if elem == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// globs returns the globs that m tries to match.
+func (m *globMatcher) globs() []string {
+	if m.alternatives != nil {
+		return m.alternatives
+	}
+	return []string{m.glob}
+}
+
+// expandBraces expands the brace alternations in glob, as a shell does:
+// a{b,c}d becomes abd and acd. Braces may be nested, and an alternative may be
+// empty. A brace that isn't part of a group with a comma (including {}), is
+// escaped with a backslash, or is inside a character class is left as it is.
+func expandBraces(glob string) []string {
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '\\':
+			i++
+		case '[':
+			if j := strings.IndexByte(glob[i+1:], ']'); j >= 0 {
+				i += j + 1
+			}
+		case '{':
+			end, commas := braceGroup(glob, i)
+			if end < 0 || len(commas) == 0 {
+				continue
+			}
+			// Everything before i is literal, so expanding each
+			// alternative with the rest of the glob handles any
+			// nested and later groups.
+			var expanded []string
+			start := i + 1
+			for _, sep := range append(commas, end) {
+				alt := glob[:i] + glob[start:sep] + glob[end+1:]
+				expanded = append(expanded, expandBraces(alt)...)
+				start = sep + 1
+			}
+			return expanded
+		}
+	}
+	return []string{glob}
+}
+
+// braceGroup finds the end of the brace group that starts at glob[start] (a
+// {). It returns the index of the closing } and of each comma that separates
+// alternatives in the group, or -1 if the group isn't closed.
+func braceGroup(glob string, start int) (end int, commas []int) {
+	depth := 0
+	for i := start + 1; i < len(glob); i++ {
+		switch glob[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i, commas
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				commas = append(commas, i)
+			}
+		}
+	}
+	return -1, nil
+}
+
+// matched returns the part of name that the glob is matched against: the last
+// path element (without a directory's trailing /) with --match-basename, or
+// else all of it.
+func (m *globMatcher) matched(name string) string {
+	if !m.basename {
+		return name
+	}
+	return path.Base(strings.TrimSuffix(name, "/"))
+}
+
+// fold returns name lower-cased if m ignores case.
+func (m *globMatcher) fold(name string) string {
+	if m.ignoreCase {
+		return strings.ToLower(name)
+	}
+	return name
 }
 
 func (m *globMatcher) Match(name string) bool {
-	matches, err := filepath.Match(m.glob, name)
+	return (m.matching(name) != "") != m.inverse
+}
+
+// matching returns the first of m's globs that matches name (ignoring
+// m.inverse), or "" if none does.
+func (m *globMatcher) matching(name string) string {
+	name = m.fold(m.matched(name))
+	for _, glob := range m.globs() {
+		var matches bool
+		if regex, ok := m.recursive[glob]; ok {
+			matches = regex.MatchString(name)
+		} else {
+			var err error
+			if matches, err = filepath.Match(glob, name); err != nil {
+				continue
+			}
+		}
+		if matches && m.skipDotfiles {
+			matches = !wildcardDotfile(glob, name)
+		}
+		if matches {
+			return glob
+		}
+	}
+	return ""
+}
+
+// wildcardDotfile reports whether, in a name matched by glob, some path element
+// starting with . is matched by a glob element that doesn't start with a
+// literal . (and so starts with a wildcard). A shell glob would not match
+// such a name.
+func wildcardDotfile(glob, name string) bool {
+	globElems := strings.Split(glob, "/")
+	nameElems := strings.Split(name, "/")
+	if len(globElems) != len(nameElems) {
+		if !hasDoubleStar(glob) {
+			return false
+		}
+		// The elements don't line up, so be strict: a dotfile
+		// anywhere must be matched by some literal . in the glob.
+		for _, g := range globElems {
+			if strings.HasPrefix(g, ".") || strings.HasPrefix(g, `\.`) {
+				return false
+			}
+		}
+		for _, elem := range nameElems {
+			if strings.HasPrefix(elem, ".") {
+				return true
+			}
+		}
+		return false
+	}
+	for i, elem := range nameElems {
+		if !strings.HasPrefix(elem, ".") {
+			continue
+		}
+		g := globElems[i]
+		if !strings.HasPrefix(g, ".") && !strings.HasPrefix(g, `\.`) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExcludePrefix reports whether no name inside the directory prefix can be
+// matched (or, for an inverted glob, whether every such name is matched, as
+// with a glob like vendor/**).
+func (m *globMatcher) ExcludePrefix(prefix string) bool {
+	if prefix == "" || m.basename {
+		return false
+	}
+	dirs := strings.Split(strings.TrimSuffix(m.fold(prefix), "/"), "/")
+	if m.inverse {
+		if m.skipDotfiles {
+			// A ** might not match some dotfiles inside.
+			return false
+		}
+		for _, glob := range m.globs() {
+			if globCoversDir(strings.Split(glob, "/"), dirs) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, glob := range m.globs() {
+		if globCouldMatchInside(strings.Split(glob, "/"), dirs) {
+			return false
+		}
+	}
+	return true
+}
+
+// globCouldMatchInside reports whether the glob with the path elements
+// globElems might match a name inside the directory with the path elements
+// dirs.
+func globCouldMatchInside(globElems, dirs []string) bool {
+	switch {
+	case len(globElems) == 0:
+		return false
+	case globElems[0] == "**":
+		return true
+	case len(dirs) == 0:
+		// The rest of the glob is left for the name inside.
+		return true
+	}
+	matches, err := path.Match(globElems[0], dirs[0])
 	if err != nil {
+		return true
+	}
+	return matches && globCouldMatchInside(globElems[1:], dirs[1:])
+}
+
+// globCoversDir reports whether the glob with the path elements globElems
+// matches every name inside the directory with the path elements dirs (as
+// vendor/** covers vendor and **/node_modules/** covers a/node_modules).
+func globCoversDir(globElems, dirs []string) bool {
+	switch {
+	case len(globElems) == 0:
+		return false
+	case globElems[0] == "**":
+		if len(globElems) == 1 {
+			return true
+		}
+		for i := range dirs {
+			if globCoversDir(globElems[1:], dirs[i:]) {
+				return true
+			}
+		}
+		return false
+	case len(dirs) == 0:
 		return false
 	}
-	return matches != m.inverse
+	matches, err := path.Match(globElems[0], dirs[0])
+	return err == nil && matches && globCoversDir(globElems[1:], dirs[1:])
 }
 
-func (m *globMatcher) ExcludePrefix(prefix string) bool { return false }
+// Submatches returns the parts of name matched by each wildcard (*, ?, or
+// character class) in the glob.
+func (m *globMatcher) Submatches(name string) []string {
+	if m.inverse {
+		return nil
+	}
+	glob := m.matching(name)
+	if glob == "" {
+		return nil
+	}
+	expr := globToRegexp(glob)
+	if m.ignoreCase {
+		// Give the parts of name in their original case.
+		expr = "(?i)" + expr
+	}
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil
+	}
+	match := regex.FindStringSubmatch(m.matched(name))
+	if match == nil {
+		return nil
+	}
+	return match[1:]
+}
 
 func (m *globMatcher) String() string {
 	s := "Glob"
 	if m.inverse {
 		s = "Inverted glob"
 	}
-	return fmt.Sprintf("%s match: %q", s, m.glob)
+	s = fmt.Sprintf("%s match: %q", s, m.glob)
+	if m.skipDotfiles {
+		s += " (skipping dotfiles)"
+	}
+	if len(m.alternatives) > 1 {
+		s += fmt.Sprintf(" (any of %s)", strings.Join(m.alternatives, ", "))
+	}
+	if m.basename {
+		s += " (base name only)"
+	}
+	if m.ignoreCase {
+		s += " (ignoring case)"
+	}
+	return s
 }
 
 type regexMatcher struct {
@@ -97,6 +514,18 @@ func (m *regexMatcher) Match(name string) bool {
 	return m.regex.MatchString(name) != m.inverse
 }
 
+// Submatches returns the parts of name matched by the regex's capture groups.
+func (m *regexMatcher) Submatches(name string) []string {
+	if m.inverse {
+		return nil
+	}
+	match := m.regex.FindStringSubmatch(name)
+	if match == nil {
+		return nil
+	}
+	return match[1:]
+}
+
 func newRegexMatcher(regex *regexp.Regexp, inverse bool) *regexMatcher {
 	return &regexMatcher{
 		regex:   regex,
@@ -197,3 +626,266 @@ func (m multiMatcher) String() string {
 	}
 	return strings.Join(s, "\n")
 }
+
+// gitignoreFiles are the files that a gitignoreMatcher reads patterns from, in
+// each directory.
+var gitignoreFiles = []string{".gitignore", ".reflexignore"}
+
+// A gitignoreMatcher excludes the paths ignored by the .gitignore and
+// .reflexignore files in root and its subdirectories, for --gitignore. As with
+// git, the patterns in a file apply to the paths below its directory, a later
+// pattern overrides an earlier one, a deeper file overrides a shallower one,
+// and nothing below an ignored directory can be re-included.
+//
+// The files in each directory are read the first time they're needed and
+// again after they change.
+type gitignoreMatcher struct {
+	root string
+
+	mu    sync.Mutex
+	rules map[string][]gitignoreRule // by directory (relative to root; "" for root)
+}
+
+type gitignoreRule struct {
+	regex   *regexp.Regexp // matches paths relative to the rule's directory
+	negate  bool           // the pattern started with !
+	dirOnly bool           // the pattern ended with /
+}
+
+func newGitignoreMatcher(root string) *gitignoreMatcher {
+	return &gitignoreMatcher{root: root, rules: make(map[string][]gitignoreRule)}
+}
+
+func (m *gitignoreMatcher) Match(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, file := range gitignoreFiles {
+		if name == file || strings.HasSuffix(name, "/"+file) {
+			// Read the changed file again next time.
+			delete(m.rules, strings.TrimSuffix(strings.TrimSuffix(name, file), "/"))
+		}
+	}
+	return !m.ignored(name)
+}
+
+func (m *gitignoreMatcher) ExcludePrefix(prefix string) bool {
+	if !strings.HasSuffix(prefix, "/") {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ignored(prefix)
+}
+
+func (m *gitignoreMatcher) String() string {
+	return fmt.Sprintf("Excluding paths ignored by %s", strings.Join(gitignoreFiles, " and "))
+}
+
+// ignored reports whether name (a path relative to root, with a trailing / if
+// it's a directory) is ignored, either itself or because one of its parent
+// directories is.
+func (m *gitignoreMatcher) ignored(name string) bool {
+	dir := strings.HasSuffix(name, "/")
+	elems := strings.Split(strings.TrimSuffix(name, "/"), "/")
+	if name == "" || elems[0] == ".." || path.IsAbs(name) {
+		return false
+	}
+	for i := 1; i <= len(elems); i++ {
+		if m.ignoredBy(elems[:i], dir || i < len(elems)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredBy reports whether the rules of the directories above the path
+// made up of elems ignore that path itself.
+func (m *gitignoreMatcher) ignoredBy(elems []string, dir bool) bool {
+	ignored := false
+	for i := 0; i < len(elems); i++ {
+		ruleDir := strings.Join(elems[:i], "/")
+		rel := strings.Join(elems[i:], "/")
+		for _, rule := range m.rulesFor(ruleDir) {
+			if rule.dirOnly && !dir {
+				continue
+			}
+			if rule.regex.MatchString(rel) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// rulesFor returns the rules from the ignore files in dir, reading them if
+// necessary.
+func (m *gitignoreMatcher) rulesFor(dir string) []gitignoreRule {
+	if rules, ok := m.rules[dir]; ok {
+		return rules
+	}
+	var rules []gitignoreRule
+	for _, file := range gitignoreFiles {
+		f, err := os.Open(filepath.Join(m.root, filepath.FromSlash(dir), file))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if rule, ok := parseGitignoreLine(scanner.Text()); ok {
+				rules = append(rules, rule)
+			}
+		}
+		f.Close()
+	}
+	m.rules[dir] = rules
+	return rules
+}
+
+// parseGitignoreLine parses a line of a .gitignore file. It returns false for
+// blank lines, comments, and patterns that can't be parsed.
+func parseGitignoreLine(line string) (gitignoreRule, bool) {
+	var rule gitignoreRule
+	line = strings.TrimRight(line, " \t\r")
+	if strings.HasSuffix(line, "\\") {
+		line += " " // the space was escaped
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A pattern with a / (other than at the end) is relative to the
+	// directory of the file; otherwise, it can match at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return rule, false
+	}
+	expr := gitignoreToRegexp(line)
+	if !anchored {
+		expr = "(.*/)?" + expr
+	}
+	regex, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return rule, false
+	}
+	rule.regex = regex
+	return rule, true
+}
+
+// gitignoreToRegexp translates a gitignore pattern (with no leading or trailing
+// /) into a regular expression. It is like globToRegexp, except that it
+// handles ** and has no capture groups.
+func gitignoreToRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			// Zero or more directories.
+			b.WriteString("(.*/)?")
+			i += 2
+		case pattern[i:] == "**" && i > 0 && pattern[i-1] == '/':
+			// Everything inside.
+			b.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+		case pattern[i] == '?':
+			b.WriteString("[^/]")
+		case pattern[i] == '[':
+			j := i + 1
+			var class strings.Builder
+			class.WriteString("[")
+			if j < len(pattern) && (pattern[j] == '!' || pattern[j] == '^') {
+				class.WriteString("^/")
+				j++
+			}
+			for ; j < len(pattern) && pattern[j] != ']'; j++ {
+				if pattern[j] == '\\' && j+1 < len(pattern) {
+					j++
+				}
+				if pattern[j] == '-' {
+					class.WriteByte('-')
+				} else {
+					class.WriteString(regexp.QuoteMeta(pattern[j : j+1]))
+				}
+			}
+			if j == len(pattern) {
+				// No closing ]; match a literal [.
+				b.WriteString(`\[`)
+				continue
+			}
+			class.WriteString("]")
+			b.WriteString(class.String())
+			i = j
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// globToRegexp translates a glob (using the syntax of filepath.Match, plus **
+// elements) into an equivalent regular expression in which each wildcard is a
+// capture group. A ** element captures the directories it matches, without
+// the final /.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		atElem := i == 0 || glob[i-1] == '/'
+		switch {
+		case atElem && strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:(.*)/)?")
+			i += 2
+			continue
+		case atElem && glob[i:] == "**":
+			b.WriteString("(.*)")
+			i++
+			continue
+		}
+		switch glob[i] {
+		case '*':
+			b.WriteString("([^/]*)")
+		case '?':
+			b.WriteString("([^/])")
+		case '[':
+			j := i + 1
+			b.WriteString("([")
+			if j < len(glob) && glob[j] == '^' {
+				b.WriteString("^/")
+				j++
+			}
+			for ; j < len(glob) && glob[j] != ']'; j++ {
+				if glob[j] == '\\' && j+1 < len(glob) {
+					j++
+				}
+				if glob[j] == '-' {
+					b.WriteByte('-')
+				} else {
+					b.WriteString(regexp.QuoteMeta(glob[j : j+1]))
+				}
+			}
+			b.WriteString("])")
+			i = j
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"testing"
 )
@@ -41,12 +45,250 @@ func TestMatchers(t *testing.T) {
 		{multi, "foo.go", true},
 		{multi, "foo/bar.go", true},
 		{multi, "foobar/blah.go", false},
+
+		// Matching is case-sensitive.
+		{glob, "FOO", false},
+		{regex, "Foobar", false},
+		{globInv, "FOO", true},
+	} {
+		if got := tt.m.Match(tt.s); got != tt.want {
+			t.Errorf("(%v).Match(%q): got %t; want %t",
+				tt.m, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestDoubleStarGlobs(t *testing.T) {
+	var (
+		deep      = newGlobMatcher("pkg/**/*.proto", false, matchOptions{})
+		anywhere  = newGlobMatcher("**/*.go", false, matchOptions{})
+		inside    = newGlobMatcher("vendor/**", false, matchOptions{})
+		insideInv = newGlobMatcher("vendor/**", true, matchOptions{})
+		braces    = newGlobMatcher("{src,test}/**/*.js", false, matchOptions{})
+		noDots    = newGlobMatcher("**/*.go", false, matchOptions{skipDotfiles: true})
+	)
+	for _, tt := range []struct {
+		m    Matcher
+		s    string
+		want bool
+	}{
+		{deep, "pkg/a.proto", true},
+		{deep, "pkg/x/a.proto", true},
+		{deep, "pkg/x/y/a.proto", true},
+		{deep, "pkg/x/y/a.go", false},
+		{deep, "other/pkg/a.proto", false},
+		{deep, "pkgs/a.proto", false},
+
+		{anywhere, "main.go", true},
+		{anywhere, "a/b/c/main.go", true},
+		{anywhere, "a/b/c/main.go.orig", false},
+
+		{inside, "vendor/a", true},
+		{inside, "vendor/a/b.go", true},
+		{inside, "vendored/a", false},
+		{insideInv, "vendor/a/b.go", false},
+		{insideInv, "main.go", true},
+
+		{braces, "src/a/b.js", true},
+		{braces, "test/b.js", true},
+		{braces, "lib/b.js", false},
+
+		{noDots, "a/main.go", true},
+		{noDots, ".git/main.go", false},
+
+		// A ** within an element is just like *.
+		{newGlobMatcher("a**b", false, matchOptions{}), "axxb", true},
+		{newGlobMatcher("a**b", false, matchOptions{}), "ax/xb", false},
 	} {
 		if got := tt.m.Match(tt.s); got != tt.want {
 			t.Errorf("(%v).Match(%q): got %t; want %t",
 				tt.m, tt.s, got, tt.want)
 		}
 	}
+
+	for _, tt := range []struct {
+		m      Matcher
+		prefix string
+		want   bool
+	}{
+		{deep, "pkg/", false},
+		{deep, "pkg/x/y/", false},
+		{deep, "other/", true},
+		{anywhere, "a/b/", false},
+		{newGlobMatcher("*.go", false, matchOptions{}), "sub/", true},
+		{newGlobMatcher("src/*.go", false, matchOptions{}), "src/", false},
+		{newGlobMatcher("src/*.go", false, matchOptions{}), "src/sub/", true},
+		{insideInv, "vendor/", true},
+		{insideInv, "vendor/x/", true},
+		{insideInv, "src/", false},
+		{newGlobMatcher("**/node_modules/**", true, matchOptions{}), "a/b/node_modules/", true},
+		{newGlobMatcher("**/node_modules/**", true, matchOptions{}), "a/b/", false},
+		{braces, "test/", false},
+		{braces, "lib/", true},
+		{newGlobMatcher("*.go", false, matchOptions{basename: true}), "sub/", false},
+	} {
+		if got := tt.m.ExcludePrefix(tt.prefix); got != tt.want {
+			t.Errorf("(%v).ExcludePrefix(%q): got %t; want %t",
+				tt.m, tt.prefix, got, tt.want)
+		}
+	}
+
+	if got, want := submatches(deep, "pkg/x/y/a.proto"), []string{"x/y", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("submatches: got %q; want %q", got, want)
+	}
+}
+
+func TestIgnoreCase(t *testing.T) {
+	m, err := ParseMatchers([]string{`\.JPG$`}, []string{"^TMP/"}, []string{"Photos/**"}, []string{"*/RAW_*"},
+		matchOptions{ignoreCase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		s    string
+		want bool
+	}{
+		{"photos/a.jpg", true},
+		{"PHOTOS/x/A.Jpg", true},
+		{"photos/a.png", false},
+		{"photos/raw_a.jpg", false},
+		{"tmp/photos/a.jpg", false},
+		{"Tmp/photos/a.jpg", false},
+	} {
+		if got := m.Match(tt.s); got != tt.want {
+			t.Errorf("Match(%q): got %t; want %t", tt.s, got, tt.want)
+		}
+	}
+	if !m.ExcludePrefix("Tmp/") {
+		t.Error(`ExcludePrefix("Tmp/"): got false; want true`)
+	}
+	if m.ExcludePrefix("PHOTOS/") {
+		t.Error(`ExcludePrefix("PHOTOS/"): got true; want false`)
+	}
+
+	g := newGlobMatcher("IMG_*.{jpg,JPEG}", false, matchOptions{ignoreCase: true})
+	if got, want := g.Submatches("img_Beach.jpeg"), []string{"Beach"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Submatches: got %q; want %q", got, want)
+	}
+	if got, want := g.String(), `Glob match: "IMG_*.{jpg,JPEG}" (any of img_*.jpg, img_*.jpeg) (ignoring case)`; got != want {
+		t.Errorf("String: got %q; want %q", got, want)
+	}
+}
+
+func TestGlobDotfiles(t *testing.T) {
+	for _, tt := range []struct {
+		glob         string
+		name         string
+		dotfiles     bool // match with the default behavior
+		skipDotfiles bool // match with --glob-dotfiles=false
+	}{
+		{"*.go", "main.go", true, true},
+		{"*.go", ".hidden.go", true, false},
+		{".*.go", ".hidden.go", true, true},
+		{`\.*.go`, ".hidden.go", true, true},
+		{"?hidden.go", ".hidden.go", true, false},
+		{"[.]hidden.go", ".hidden.go", true, false},
+		{"*/*.go", "src/main.go", true, true},
+		{"*/*.go", ".git/main.go", true, false},
+		{".git/*.go", ".git/main.go", true, true},
+		{"src/*", "src/.env", true, false},
+	} {
+		for _, skip := range []bool{false, true} {
+			want := tt.dotfiles
+			if skip {
+				want = tt.skipDotfiles
+			}
+			m, err := ParseMatchers(nil, nil, []string{tt.glob}, nil, matchOptions{skipDotfiles: skip})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Match(tt.name); got != want {
+				t.Errorf("glob %q with skipDotfiles=%t: Match(%q): got %t; want %t",
+					tt.glob, skip, tt.name, got, want)
+			}
+		}
+	}
+}
+
+func TestGlobMatchBasename(t *testing.T) {
+	for _, tt := range []struct {
+		glob     string
+		name     string
+		basename bool
+		want     bool
+	}{
+		{"*.go", "main.go", false, true},
+		{"*.go", "foo/bar.go", false, false},
+		{"*.go", "foo/bar.go", true, true},
+		{"*.go", "foo/bar.go.orig", true, false},
+		{"vendor", "a/vendor/", true, true},
+		// A glob with a / still matches the whole path.
+		{"foo/*.go", "foo/bar.go", true, true},
+		{"foo/*.go", "x/foo/bar.go", true, false},
+	} {
+		m, err := ParseMatchers(nil, nil, []string{tt.glob}, nil, matchOptions{basename: tt.basename})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(tt.name); got != tt.want {
+			t.Errorf("glob %q with basename=%t: Match(%q): got %t; want %t",
+				tt.glob, tt.basename, tt.name, got, tt.want)
+		}
+	}
+
+	m := newGlobMatcher("*_test.go", false, matchOptions{basename: true})
+	if got, want := m.Submatches("pkg/foo_test.go"), []string{"foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Submatches: got %q; want %q", got, want)
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	for _, tt := range []struct {
+		glob string
+		want []string
+	}{
+		{"*.go", []string{"*.go"}},
+		{"*.{js,ts}", []string{"*.js", "*.ts"}},
+		{"{a,b}/{c,d}", []string{"a/c", "a/d", "b/c", "b/d"}},
+		{"x{a,b{c,d}}y", []string{"xay", "xbcy", "xbdy"}},
+		{"a{,b}", []string{"a", "ab"}},
+		{"{}", []string{"{}"}},
+		{"{a}", []string{"{a}"}},
+		{"{a,b", []string{"{a,b"}},
+		{"{a,b}{", []string{"a{", "b{"}},
+		{`\{a,b}`, []string{`\{a,b}`}},
+		{`{a\,b,c}`, []string{`a\,b`, "c"}},
+		{"[{]a,b}", []string{"[{]a,b}"}},
+	} {
+		if got := expandBraces(tt.glob); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandBraces(%q): got %q; want %q", tt.glob, got, tt.want)
+		}
+	}
+}
+
+func TestGlobMatchBraces(t *testing.T) {
+	m, err := ParseMatchers(nil, nil, []string{"src/*.{js,ts{,x}}"}, []string{"*/gen.{js,ts}"}, matchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"src/a.js":   true,
+		"src/a.ts":   true,
+		"src/a.tsx":  true,
+		"src/a.jsx":  false,
+		"src/gen.ts": false,
+	} {
+		if got := m.Match(name); got != want {
+			t.Errorf("Match(%q): got %t; want %t", name, got, want)
+		}
+	}
+	if got, want := submatches(m, "src/a.tsx"), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("submatches: got %q; want %q", got, want)
+	}
+	g := newGlobMatcher("*.{js,ts}", false, matchOptions{})
+	if got, want := g.String(), `Glob match: "*.{js,ts}" (any of *.js, *.ts)`; got != want {
+		t.Errorf("String: got %q; want %q", got, want)
+	}
 }
 
 func TestExcludePrefix(t *testing.T) {
@@ -107,3 +349,223 @@ func TestDefaultExcludes(t *testing.T) {
 		}
 	}
 }
+
+func TestDefaultExcludeGroups(t *testing.T) {
+	for _, tt := range []struct {
+		groups string
+		name   string
+		want   bool // whether name matches (is not excluded)
+	}{
+		{"vcs,editor,os", ".git/HEAD", false},
+		{"vcs,editor,os", "foo.swp", false},
+		{"vcs", ".git/HEAD", false},
+		{"vcs", "foo.swp", true},
+		{"vcs", ".DS_Store", true},
+		{"editor, os", ".git/HEAD", true},
+		{"editor, os", "foo.swp", false},
+		{"editor, os", ".DS_Store", false},
+		{"", ".git/HEAD", true},
+	} {
+		m, err := defaultExcludeMatcherFor(tt.groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(tt.name); got != tt.want {
+			t.Errorf("--default-ignores=%q: Match(%q): got %t; want %t", tt.groups, tt.name, got, tt.want)
+		}
+	}
+	if _, err := defaultExcludeMatcherFor("vcs,ide"); err == nil {
+		t.Error("defaultExcludeMatcherFor with an unknown group: got no error")
+	}
+}
+
+func TestUserExcludes(t *testing.T) {
+	defer func() {
+		userExcludes = nil
+		userExcludeMatcher = nil
+	}()
+	if err := addUserExcludes([]string{"("}); err == nil {
+		t.Error("addUserExcludes with a bad regex: got no error")
+	}
+	if err := addUserExcludes([]string{`^build/`, `\.log$`}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestReflex(t, "--", "true")
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"main.go", true},
+		{"build/main", false},
+		{"src/build/main", true},
+		{"debug.log", false},
+		{"foo.swp", false},
+	} {
+		if got := r.matcher.Match(tt.name); got != tt.want {
+			t.Errorf("Match(%q): got %t; want %t", tt.name, got, tt.want)
+		}
+	}
+
+	r = newTestReflex(t, "--all", "--", "true")
+	for _, name := range []string{"build/main", "debug.log"} {
+		if !r.matcher.Match(name) {
+			t.Errorf("with --all, Match(%q): got false; want true", name)
+		}
+	}
+}
+
+func TestExcludedBy(t *testing.T) {
+	vendor := newRegexMatcher(regexp.MustCompile("^vendor/"), true)
+	m := multiMatcher{
+		defaultExcludeMatcher,
+		multiMatcher{
+			newRegexMatcher(regexp.MustCompile(`\.go$`), false),
+			vendor,
+		},
+	}
+	for _, tt := range []struct {
+		prefix string
+		want   Matcher
+	}{
+		{"foo/", nil},
+		{"vendor/", vendor},
+		{".git/", defaultExcludeMatcher[0]},
+	} {
+		if got := excludedBy(m, tt.prefix); got != tt.want {
+			t.Errorf("excludedBy(m, %q): got %v; want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestRejectedBy(t *testing.T) {
+	goFiles := newRegexMatcher(regexp.MustCompile(`\.go$`), false)
+	vendor := newRegexMatcher(regexp.MustCompile("^vendor/"), true)
+	m := multiMatcher{
+		defaultExcludeMatcher,
+		multiMatcher{goFiles, vendor},
+	}
+	for _, tt := range []struct {
+		name string
+		want Matcher
+	}{
+		{"main.go", nil},
+		{"README.md", goFiles},
+		{"vendor/x.go", vendor},
+		{"main.go~", defaultExcludeMatcher[2]},
+	} {
+		if got := rejectedBy(m, tt.name); got != tt.want {
+			t.Errorf("rejectedBy(m, %q): got %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSubmatches(t *testing.T) {
+	for _, tt := range []struct {
+		m    Matcher
+		name string
+		want []string
+	}{
+		{&globMatcher{glob: "proto/*/*.proto"}, "proto/foo/bar.proto", []string{"foo", "bar"}},
+		{&globMatcher{glob: "a?c/[0-9]x/[^a]"}, "abc/5x/b", []string{"b", "5", "b"}},
+		{&globMatcher{glob: `\*/*`}, "*/foo", []string{"foo"}},
+		{&globMatcher{glob: "proto/*.proto"}, "proto/foo/bar.proto", nil},
+		{&globMatcher{glob: "*.go", inverse: true}, "foo.go", nil},
+		{newRegexMatcher(regexp.MustCompile(`^(\w+)/(\w+)\.go$`), false), "foo/bar.go", []string{"foo", "bar"}},
+		{newRegexMatcher(regexp.MustCompile(`(\w+)\.go$`), true), "foo/bar.go", nil},
+		{
+			multiMatcher{
+				defaultExcludeMatcher,
+				newRegexMatcher(regexp.MustCompile(`\.go$`), false),
+				&globMatcher{glob: "*/*.go"},
+			},
+			"foo/bar.go",
+			[]string{"foo", "bar"},
+		},
+	} {
+		if got := submatches(tt.m, tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("submatches(%v, %q): got %q; want %q", tt.m, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGitignoreMatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "reflex-gitignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	write := func(name, contents string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(".gitignore", `# Build output.
+*.log
+/build/
+node_modules/
+!keep.log
+docs/**/*.tmp
+foo/**
+\#notes
+`)
+	write("sub/.gitignore", "*.gen.go\n!important.log\nlocal/\n")
+	write(".reflexignore", "secret.txt\n")
+
+	m := newGitignoreMatcher(root)
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"main.go", true},
+		{"a.log", false},
+		{"x/a.log", false},
+		{"keep.log", true},
+		{"sub/important.log", true},
+		{"build/", false},
+		{"build/x.go", false},
+		{"sub/build/x.go", true},
+		{"node_modules/", false},
+		{"a/node_modules/x.js", false},
+		{"node_modules", true}, // a file, not a directory
+		{"docs/a.tmp", false},
+		{"docs/x/y/a.tmp", false},
+		{"docs/a.txt", true},
+		{"foo", true},
+		{"foo/x", false},
+		{"#notes", false},
+		{"sub/x.gen.go", false},
+		{"x.gen.go", true},
+		{"sub/local/f", false},
+		{"secret.txt", false},
+	} {
+		if got := m.Match(tt.name); got != tt.want {
+			t.Errorf("Match(%q): got %t; want %t", tt.name, got, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		prefix string
+		want   bool
+	}{
+		{"build/", true},
+		{"node_modules/", true},
+		{"sub/local/", true},
+		{"sub/", false},
+		{"sub/build/", false},
+	} {
+		if got := m.ExcludePrefix(tt.prefix); got != tt.want {
+			t.Errorf("ExcludePrefix(%q): got %t; want %t", tt.prefix, got, tt.want)
+		}
+	}
+
+	// A change to an ignore file is picked up.
+	write(".reflexignore", "secret.txt\nmain.go\n")
+	m.Match(".reflexignore")
+	if m.Match("main.go") {
+		t.Error("Match(\"main.go\"): got true after adding it to .reflexignore")
+	}
+}
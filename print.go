@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Decoration int
@@ -12,57 +16,325 @@ const (
 	DecorationNone = iota
 	DecorationPlain
 	DecorationFancy
+	DecorationJSON
 )
 
 const (
-	colorRed = 31
-	// ANSI colors -- using 32 - 36
-	colorStart = 32
-	numColors  = 5
+	colorRed   = 31
+	colorGreen = 32
 )
 
+// fancyColors are the ANSI colors given to the commands' output with fancy
+// decoration, round-robin by reflex id. They can be set with --colors.
+var fancyColors = []int{32, 33, 34, 35, 36}
+
+// colorNames are the names that --colors accepts in place of ANSI codes.
+var colorNames = map[string]int{
+	"black":   30,
+	"red":     31,
+	"green":   32,
+	"yellow":  33,
+	"blue":    34,
+	"magenta": 35,
+	"cyan":    36,
+	"white":   37,
+}
+
+// parseColors parses the --colors list: ANSI foreground color codes (30-37 or,
+// for the bright colors, 90-97) or names from colorNames (with a "bright-"
+// prefix for the bright colors), separated by commas.
+func parseColors(s string) ([]int, error) {
+	var colors []int
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		bright := strings.HasPrefix(name, "bright-")
+		if code, ok := colorNames[strings.TrimPrefix(name, "bright-")]; ok {
+			if bright {
+				code += 60
+			}
+			colors = append(colors, code)
+			continue
+		}
+		code, err := strconv.Atoi(name)
+		if err != nil || !(code >= 30 && code <= 37 || code >= 90 && code <= 97) {
+			return nil, fmt.Errorf("%q is not a color name or an ANSI foreground color code (30-37 or 90-97)", name)
+		}
+		colors = append(colors, code)
+	}
+	return colors, nil
+}
+
 type OutMsg struct {
 	reflexID int
+	name     string // the --name of the reflex, if any
 	msg      string
+	raw      bool // write msg as-is, without decoration or a newline
+	color    int  // if nonzero, the color to use in fancy mode
+	info     bool // msg is from reflex, not the output of a command
+	stderr   bool // msg is from the command's stderr (only with --no-pty)
+	end      bool // not a message: the command's output has ended
 }
 
 func infoPrintln(id int, args ...interface{}) {
-	stdout <- OutMsg{id, strings.TrimSpace(fmt.Sprintln(args...))}
+	stdout <- OutMsg{reflexID: id, msg: strings.TrimSpace(fmt.Sprintln(args...)), info: true}
 }
 func infoPrintf(id int, format string, args ...interface{}) {
-	stdout <- OutMsg{id, fmt.Sprintf(format, args...)}
+	stdout <- OutMsg{reflexID: id, msg: fmt.Sprintf(format, args...), info: true}
+}
+
+// The Reflex versions of the functions above mark the message with r's --name.
+
+func (r *Reflex) infoPrintln(args ...interface{}) {
+	stdout <- OutMsg{reflexID: r.id, name: r.name, msg: strings.TrimSpace(fmt.Sprintln(args...)), info: true}
+}
+func (r *Reflex) infoPrintf(format string, args ...interface{}) {
+	stdout <- OutMsg{reflexID: r.id, name: r.name, msg: fmt.Sprintf(format, args...), info: true}
+}
+
+// terseLifecycleMessages are the short forms of the lifecycle messages, used
+// with --terse-info. They all start with "~ " so that they are easy to filter.
+// (The messages about sending a signal, like "Sending SIGINT signal...", are
+// shortened to "~ SIGINT" and so on.)
+var terseLifecycleMessages = map[string]string{
+	"Starting service": "~ start",
+	"Killing service":  "~ kill",
+	"Service ready":    "~ ready",
 }
 
-func printMsg(msg OutMsg, writer io.Writer) {
+// lifecyclePrintln prints one of the messages in terseLifecycleMessages,
+// shortened if --terse-info is set.
+func (r *Reflex) lifecyclePrintln(msg string) {
+	r.infoPrintln(lifecycleMessage(msg, flagTerseInfo))
+}
+
+// lifecycleMessage returns the short form of msg if terse is set and msg has
+// one.
+func lifecycleMessage(msg string, terse bool) string {
+	if !terse {
+		return msg
+	}
+	if short, ok := terseLifecycleMessages[msg]; ok {
+		return short
+	}
+	if strings.HasPrefix(msg, "Sending ") && strings.HasSuffix(msg, " signal...") {
+		return "~ " + strings.TrimSuffix(strings.TrimPrefix(msg, "Sending "), " signal...")
+	}
+	return msg
+}
+
+func printMsg(msg OutMsg, writer io.Writer, dedup *lineDeduper) {
+	if msg.end {
+		dedup.flush(msg.reflexID, writer)
+		return
+	}
+	if msg.raw {
+		dedup.flush(msg.reflexID, writer)
+		if decoration == DecorationJSON {
+			printJSON(msg, msg.msg, writer)
+			return
+		}
+		fmt.Fprint(writer, msg.msg)
+		return
+	}
+	// A message may hold several lines (see scanLines); each one is
+	// decorated.
+	for _, line := range strings.Split(strings.TrimSuffix(msg.msg, "\n"), "\n") {
+		if dedup == nil {
+			printLine(msg, line, writer)
+			continue
+		}
+		dedup.add(msg, line, time.Now(), writer)
+	}
+}
+
+// A lineDeduper collapses runs of identical lines from the same reflex, for
+// --dedup-output. Each line is held back until its run ends, and is then
+// printed once, with an (xN) suffix if it came N > 1 times in a row. A run
+// ends when the reflex prints a different line, when its command's output
+// ends, or when the line hasn't come again for dedupIdleFlush.
+type lineDeduper struct {
+	runs map[int]*lineRun // by reflex ID
+}
+
+type lineRun struct {
+	msg   OutMsg // the message the line came from, for decorating it
+	line  string
+	count int
+	last  time.Time // when the line last came
+}
+
+func newLineDeduper() *lineDeduper {
+	return &lineDeduper{runs: make(map[int]*lineRun)}
+}
+
+// add counts line, from msg, toward the current run from its reflex, or prints
+// that run and starts a new one.
+func (d *lineDeduper) add(msg OutMsg, line string, now time.Time, writer io.Writer) {
+	if run, ok := d.runs[msg.reflexID]; ok && run.line == line {
+		run.count++
+		run.last = now
+		return
+	}
+	d.flush(msg.reflexID, writer)
+	d.runs[msg.reflexID] = &lineRun{msg: msg, line: line, count: 1, last: now}
+}
+
+// flush prints the current run from reflex id, if any, and forgets it.
+func (d *lineDeduper) flush(id int, writer io.Writer) {
+	if d == nil {
+		return
+	}
+	run, ok := d.runs[id]
+	if !ok {
+		return
+	}
+	line := run.line
+	if run.count > 1 {
+		line = fmt.Sprintf("%s (x%d)", line, run.count)
+	}
+	printLine(run.msg, line, writer)
+	delete(d.runs, id)
+}
+
+// flushIdle prints the runs whose line hasn't come for dedupIdleFlush as of
+// now. It returns when the next of the remaining runs goes idle (or the zero
+// Time if there are none).
+func (d *lineDeduper) flushIdle(now time.Time, writer io.Writer) time.Time {
+	var next time.Time
+	for id, run := range d.runs {
+		idle := run.last.Add(dedupIdleFlush)
+		if !idle.After(now) {
+			d.flush(id, writer)
+			continue
+		}
+		if next.IsZero() || idle.Before(next) {
+			next = idle
+		}
+	}
+	return next
+}
+
+// flushAll prints all the current runs.
+func (d *lineDeduper) flushAll(writer io.Writer) {
+	for id := range d.runs {
+		d.flush(id, writer)
+	}
+}
+
+func printLine(msg OutMsg, line string, writer io.Writer) {
+	if decoration == DecorationJSON {
+		printJSON(msg, line, writer)
+		return
+	}
 	tag := ""
 	if decoration == DecorationFancy || decoration == DecorationPlain {
 		if msg.reflexID < 0 {
 			tag = "[info]"
+		} else if msg.name != "" {
+			tag = "[" + msg.name + "]"
 		} else {
 			tag = fmt.Sprintf("[%02d]", msg.reflexID)
 		}
 	}
+	if timestampLayout != "" {
+		// The time goes before the tag so that the lines line up.
+		stamp := time.Now().Format(timestampLayout)
+		if tag == "" {
+			tag = stamp
+		} else {
+			tag = stamp + " " + tag
+		}
+	}
 
 	if decoration == DecorationFancy {
-		color := (msg.reflexID % numColors) + colorStart
-		if reflexID < 0 {
-			color = colorRed
+		color := colorRed
+		if msg.reflexID >= 0 && !msg.stderr {
+			color = fancyColors[msg.reflexID%len(fancyColors)]
+		}
+		if msg.color != 0 {
+			color = msg.color
 		}
 		fmt.Fprintf(writer, "\x1b[01;%dm%s ", color, tag)
-	} else if decoration == DecorationPlain {
-		fmt.Fprintf(writer, tag+" ")
+	} else if tag != "" {
+		fmt.Fprint(writer, tag+" ")
 	}
-	fmt.Fprint(writer, msg.msg)
+	fmt.Fprint(writer, line)
 	if decoration == DecorationFancy {
 		fmt.Fprintf(writer, "\x1b[m")
 	}
-	if !strings.HasSuffix(msg.msg, "\n") {
-		fmt.Fprintln(writer)
+	fmt.Fprintln(writer)
+}
+
+// A jsonEvent is a line of output with --decoration=json.
+type jsonEvent struct {
+	Reflex  int       `json:"reflex"` // -1 for reflex itself
+	Name    string    `json:"name,omitempty"`
+	Time    time.Time `json:"time"`
+	Stream  string    `json:"stream"` // "info", "output", or "stderr"
+	Message string    `json:"message"`
+}
+
+// printJSON writes line, from msg, to writer as a jsonEvent.
+func printJSON(msg OutMsg, line string, writer io.Writer) {
+	event := jsonEvent{
+		Reflex:  msg.reflexID,
+		Name:    msg.name,
+		Time:    time.Now(),
+		Stream:  "output",
+		Message: line,
+	}
+	switch {
+	case msg.info || msg.reflexID < 0:
+		event.Stream = "info"
+	case msg.stderr:
+		event.Stream = "stderr"
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		// Can't happen: every field can be marshaled.
+		panic(err)
 	}
+	fmt.Fprintf(writer, "%s\n", b)
 }
 
+// directPrintln prints an info message straight to stdout rather than through
+// the stdout channel (for use when the printer may be stuck or gone).
+func directPrintln(msg string) {
+	if decoration == DecorationJSON {
+		printJSON(OutMsg{reflexID: -1, info: true}, msg, os.Stdout)
+		return
+	}
+	fmt.Println(msg)
+}
+
+// dedupIdleFlush is how long, with --dedup-output, a held-back line waits to
+// come again before it is printed.
+const dedupIdleFlush = time.Second
+
 func printOutput(out <-chan OutMsg, outWriter io.Writer) {
-	for msg := range out {
-		printMsg(msg, outWriter)
+	if !flagDedupOutput {
+		for msg := range out {
+			printMsg(msg, outWriter, nil)
+		}
+		return
+	}
+	dedup := newLineDeduper()
+	var idle <-chan time.Time
+	for {
+		select {
+		case msg, ok := <-out:
+			if !ok {
+				dedup.flushAll(outWriter)
+				return
+			}
+			printMsg(msg, outWriter, dedup)
+		case <-idle:
+		}
+		// Each reflex's run goes idle on its own schedule, however
+		// busy the other reflexes are.
+		idle = nil
+		if next := dedup.flushIdle(time.Now(), outWriter); !next.IsZero() {
+			idle = time.After(time.Until(next))
+		}
 	}
 }
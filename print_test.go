@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifecycleMessage(t *testing.T) {
+	for _, tt := range []struct {
+		terse bool
+		msg   string
+		want  string
+	}{
+		{false, "Starting service", "Starting service"},
+		{true, "Starting service", "~ start"},
+		{true, "Sending SIGKILL signal...", "~ SIGKILL"},
+		{true, "Sending SIGTERM signal...", "~ SIGTERM"},
+		{false, "Sending SIGTERM signal...", "Sending SIGTERM signal..."},
+		{true, "Something else", "Something else"},
+	} {
+		if got := lifecycleMessage(tt.msg, tt.terse); got != tt.want {
+			t.Errorf("lifecycleMessage(%q, %t): got %q; want %q", tt.msg, tt.terse, got, tt.want)
+		}
+	}
+}
+
+func TestLineDeduper(t *testing.T) {
+	defer func(d Decoration) { decoration = d }(decoration)
+	decoration = DecorationPlain
+
+	var buf bytes.Buffer
+	dedup := newLineDeduper()
+	for _, msg := range []OutMsg{
+		{reflexID: 0, msg: "a"},
+		{reflexID: 0, msg: "retry"},
+		{reflexID: 0, msg: "retry\nretry"},
+		{reflexID: 1, msg: "x"},
+		{reflexID: 1, msg: "x"},
+		{reflexID: 0, msg: "done"},
+		{reflexID: 1, msg: "y"},
+		{reflexID: 1, msg: "y"},
+		{reflexID: 1, msg: "raw", raw: true},
+		{reflexID: 0, msg: "end"},
+		{reflexID: 0, msg: "end"},
+		{reflexID: 0, end: true},
+		{reflexID: 1, msg: "idle"},
+		{reflexID: 1, msg: "idle"},
+		{reflexID: 1, msg: "idle"},
+	} {
+		printMsg(msg, &buf, dedup)
+	}
+	dedup.flushAll(&buf)
+	want := strings.Join([]string{
+		"[00] a",
+		"[00] retry (x3)",
+		"[01] x (x2)",
+		"[01] y (x2)",
+		"raw[00] done",
+		"[00] end (x2)",
+		"[01] idle (x3)",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("got output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLineDeduperIdle(t *testing.T) {
+	defer func(d Decoration) { decoration = d }(decoration)
+	decoration = DecorationPlain
+
+	var buf bytes.Buffer
+	dedup := newLineDeduper()
+	start := time.Now()
+	dedup.add(OutMsg{reflexID: 0}, "quiet", start, &buf)
+	// Another reflex staying busy doesn't hold back the quiet one.
+	for i := 0; i < 4; i++ {
+		now := start.Add(time.Duration(i) * dedupIdleFlush / 2)
+		dedup.add(OutMsg{reflexID: 1}, "busy", now, &buf)
+		dedup.flushIdle(now, &buf)
+	}
+	if got, want := buf.String(), "[00] quiet\n"; got != want {
+		t.Errorf("got output %q; want %q", got, want)
+	}
+	if next := dedup.flushIdle(start.Add(dedupIdleFlush), &buf); !next.Equal(start.Add(dedupIdleFlush * 5 / 2)) {
+		t.Errorf("flushIdle: got next idle time %s after the start; want %s", next.Sub(start), dedupIdleFlush*5/2)
+	}
+}
+
+func TestPrintJSON(t *testing.T) {
+	defer func(d Decoration) { decoration = d }(decoration)
+	decoration = DecorationJSON
+
+	var buf bytes.Buffer
+	for _, msg := range []OutMsg{
+		{reflexID: 0, msg: "first\nsecond"},
+		{reflexID: 1, msg: "Starting service", info: true},
+		{reflexID: -1, msg: "tab\there \x1b[31mred\x1b[m \"quoted\"", info: true},
+		{reflexID: 2, msg: "10%\r50%\r", raw: true},
+		{reflexID: 2, msg: "oops", stderr: true},
+	} {
+		printMsg(msg, &buf, nil)
+	}
+	want := []jsonEvent{
+		{Reflex: 0, Stream: "output", Message: "first"},
+		{Reflex: 0, Stream: "output", Message: "second"},
+		{Reflex: 1, Stream: "info", Message: "Starting service"},
+		{Reflex: -1, Stream: "info", Message: "tab\there \x1b[31mred\x1b[m \"quoted\""},
+		{Reflex: 2, Stream: "output", Message: "10%\r50%\r"},
+		{Reflex: 2, Stream: "stderr", Message: "oops"},
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines of output; want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		var event jsonEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("line %d (%q): %s", i, line, err)
+		}
+		if event.Time.IsZero() {
+			t.Errorf("line %d (%q): no time", i, line)
+		}
+		event.Time = time.Time{}
+		if event != want[i] {
+			t.Errorf("line %d: got %+v; want %+v", i, event, want[i])
+		}
+	}
+}
+
+func TestPrintTimestamp(t *testing.T) {
+	defer func(d Decoration, layout string) {
+		decoration = d
+		timestampLayout = layout
+	}(decoration, timestampLayout)
+	timestampLayout = "15:04:05.000"
+
+	for _, tt := range []struct {
+		decoration Decoration
+		msg        OutMsg
+		want       string // regexp
+	}{
+		{DecorationPlain, OutMsg{reflexID: 3, msg: "hello\n"}, `^\d\d:\d\d:\d\d\.\d{3} \[03\] hello\n$`},
+		{DecorationPlain, OutMsg{reflexID: -1, msg: "a\nb"}, `^\d\d:\d\d:\d\d\.\d{3} \[info\] a\n\d\d:\d\d:\d\d\.\d{3} \[info\] b\n$`},
+		{DecorationNone, OutMsg{reflexID: 3, msg: "hello"}, `^\d\d:\d\d:\d\d\.\d{3} hello\n$`},
+		{DecorationFancy, OutMsg{reflexID: 0, msg: "hello"}, `^\x1b\[01;\d+m\d\d:\d\d:\d\d\.\d{3} \[00\] hello\x1b\[m\n$`},
+		{DecorationPlain, OutMsg{reflexID: 3, msg: "raw", raw: true}, `^raw$`},
+	} {
+		decoration = tt.decoration
+		var buf bytes.Buffer
+		printMsg(tt.msg, &buf, nil)
+		if !regexp.MustCompile(tt.want).MatchString(buf.String()) {
+			t.Errorf("printMsg(%+v) with decoration %d: got %q; want a match for %q",
+				tt.msg, tt.decoration, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestPrintName(t *testing.T) {
+	defer func(d Decoration) { decoration = d }(decoration)
+	msg := OutMsg{reflexID: 1000, name: "web", msg: "hello"}
+
+	for _, tt := range []struct {
+		decoration Decoration
+		want       string
+	}{
+		{DecorationPlain, "[web] hello\n"},
+		{DecorationNone, "hello\n"},
+		{DecorationFancy, "\x1b[01;32m[web] hello\x1b[m\n"},
+	} {
+		decoration = tt.decoration
+		var buf bytes.Buffer
+		printMsg(msg, &buf, nil)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("with decoration %d: got %q; want %q", tt.decoration, got, tt.want)
+		}
+	}
+
+	decoration = DecorationJSON
+	var buf bytes.Buffer
+	printMsg(msg, &buf, nil)
+	var event jsonEvent
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != "web" {
+		t.Errorf("JSON event name: got %q; want %q", event.Name, "web")
+	}
+}
+
+func TestParseColors(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want []int
+	}{
+		{"31", []int{31}},
+		{"red,green, 94", []int{31, 32, 94}},
+		{"Cyan,bright-white,97", []int{36, 97, 97}},
+	} {
+		got, err := parseColors(tt.s)
+		if err != nil {
+			t.Errorf("parseColors(%q): %s", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseColors(%q): got %v; want %v", tt.s, got, tt.want)
+		}
+	}
+	for _, s := range []string{"", "red,", "38", "0", "bright-31", "purple"} {
+		if _, err := parseColors(s); err == nil {
+			t.Errorf("parseColors(%q): got no error", s)
+		}
+	}
+}
+
+func TestPrintFancyColors(t *testing.T) {
+	defer func(d Decoration, colors []int) {
+		decoration = d
+		fancyColors = colors
+	}(decoration, fancyColors)
+	decoration = DecorationFancy
+	fancyColors = []int{91, 36}
+
+	for _, tt := range []struct {
+		id   int
+		want string
+	}{
+		{0, "\x1b[01;91m[00] hi\x1b[m\n"},
+		{1, "\x1b[01;36m[01] hi\x1b[m\n"},
+		{2, "\x1b[01;91m[02] hi\x1b[m\n"},
+		{-1, "\x1b[01;31m[info] hi\x1b[m\n"},
+	} {
+		var buf bytes.Buffer
+		printMsg(OutMsg{reflexID: tt.id, msg: "hi"}, &buf, nil)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("id %d: got %q; want %q", tt.id, got, tt.want)
+		}
+	}
+
+	// Output from stderr is red.
+	var buf bytes.Buffer
+	printMsg(OutMsg{reflexID: 1, msg: "oops", stderr: true}, &buf, nil)
+	if got, want := buf.String(), "\x1b[01;31m[01] oops\x1b[m\n"; got != want {
+		t.Errorf("stderr output: got %q; want %q", got, want)
+	}
+}
@@ -5,106 +5,495 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/creack/pty"
+	"github.com/kballard/go-shellquote"
 )
 
 // A Reflex is a single watch + command to execute.
 type Reflex struct {
 	id           int
 	source       string // Describes what config/line defines this Reflex
+	name         string // --name, if given
 	startService bool
+	defaultStart bool // start the service along with reflex
+	runAtStart   bool // run the (non-service) command along with reflex
 	backlog      Backlog
 	matcher      Matcher
+	require      []*globMatcher // --require globs, all matched by each batch
 	onlyFiles    bool
 	onlyDirs     bool
+	onlyExec     bool
 	command      []string
+	then         [][]string // commands to run after command (--then)
+	keepGoing    bool       // run the --then commands after a failure
 	subSymbol    string
-	done         chan struct{}
+	cmdFormat    bool   // the command is a --command-format template
+	shell        string // with --shell, the shell that runs the command
+	stdinFile    bool
+	runInNearest string
+	stdoutFile   string
+	stderrFile   string
+	envFile      string
+	env          []string
+	matchTokens  int // the largest N of any {match:N} in command
+	groupTokens  int // the largest N of any {N} in command
+	countToken   bool
+	readyRegex   *regexp.Regexp
+	readyTCP     string
+	readyHTTP    string
+	readyTimeout time.Duration
+	rawOutput    bool
+	noPty        bool // run the command with pipes instead of a pty
+	flushFirst   bool
+	fileDebounce bool // --debounce-per-file
+	testMode     bool
+	watchBinary  bool
+	noGroupKill  bool // signal only the command, not its process group
+	debounce     time.Duration
+	maxLatency   time.Duration
+	maxRuntime   time.Duration
+	delay        time.Duration
+	restartSig   syscall.Signal // for --restart-signal; 0 if unset
+	minRestart   time.Duration  // --min-restart-interval
+	stopSig      syscall.Signal // for --stop-signal; 0 if unset
+	realpath     bool
+
+	// If the command contains {count} (countToken), batch sends the number
+	// of files in each batch on counts just after sending runEach a path
+	// from it, and runEach keeps it in count.
+	counts chan int
+	count  int
+
+	// backlogLen is the number of paths in backlog, for debugging output.
+	// It is accessed atomically.
+	backlogLen int64
+
+	mu       *sync.Mutex // protects the following
+	killed   bool
+	timedOut bool // the command was killed for running over --max-runtime
+	running  bool
+	ready    bool          // "Service ready" has been printed for the current run
+	done     chan struct{} // closed when the current command exits
+	exitErr  error         // how the last command exited (set before closing done)
+	scanned  chan struct{} // closed when all the command's output has been read
+	started  time.Time     // when the last command started
+	cmd      *exec.Cmd
+	tty      *os.File
 
-	mu      *sync.Mutex // protects killed and running
-	killed  bool
-	running bool
 	timeout time.Duration
 
-	// Used for services (startService = true)
-	cmd *exec.Cmd
-	tty *os.File
+	// retired is closed when r is replaced by a reload of the config file.
+	retired chan struct{}
+	// stopped is closed when runEach returns (nil until Start).
+	stopped chan struct{}
 }
 
-// NewReflex prepares a Reflex from a Config, with sanity checking.
+// NewReflex prepares a Reflex from a Config, with sanity checking. Errors
+// say where the Config came from (such as the line of the config file).
 func NewReflex(c *Config) (*Reflex, error) {
-	matcher, err := ParseMatchers(c.regexes, c.inverseRegexes, c.globs, c.inverseGlobs)
+	r, err := newReflex(c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.source, err)
+	}
+	return r, nil
+}
+
+func newReflex(c *Config) (*Reflex, error) {
+	regexes, err := readPatternFiles(c.regexes, c.regexFiles)
+	if err != nil {
+		return nil, err
+	}
+	inverseRegexes, err := readPatternFiles(c.inverseRegexes, c.inverseRegexFiles)
+	if err != nil {
+		return nil, err
+	}
+	globs, err := readPatternFiles(c.globs, c.globFiles)
+	if err != nil {
+		return nil, err
+	}
+	inverseGlobs, err := readPatternFiles(c.inverseGlobs, c.inverseGlobFiles)
+	if err != nil {
+		return nil, err
+	}
+	opts := matchOptions{
+		skipDotfiles: !c.globDotfiles,
+		basename:     c.matchBasename,
+		ignoreCase:   c.ignoreCase || !flagCaseSensitive,
+	}
+	matcher, err := ParseMatchers(regexes, inverseRegexes, globs, inverseGlobs, opts)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing glob/regex: %s", err)
 	}
 	if !c.allFiles {
-		matcher = multiMatcher{defaultExcludeMatcher, matcher}
+		excludes, err := defaultExcludeMatcherFor(c.defaultIgnores)
+		if err != nil {
+			return nil, fmt.Errorf("bad --default-ignores: %s", err)
+		}
+		matcher = multiMatcher{excludes, matcher}
+		if len(userExcludeMatcher) > 0 {
+			matcher = multiMatcher{userExcludeMatcher, matcher}
+		}
+	}
+	if c.gitignore {
+		matcher = multiMatcher{newGitignoreMatcher("."), matcher}
+	}
+	var require []*globMatcher
+	for _, glob := range c.require {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("bad --require glob %q: %s", glob, err)
+		}
+		require = append(require, newGlobMatcher(glob, false, opts))
 	}
-	if len(c.command) == 0 {
+	if len(c.command) == 0 && !flagExplainWatches && !flagWaitForOne {
 		return nil, errors.New("must give command to execute")
 	}
+	if flagWaitForOne && c.startService {
+		return nil, errors.New("cannot use --start-service with --wait-for-one")
+	}
 
 	if c.subSymbol == "" {
 		return nil, errors.New("substitution symbol must be non-empty")
 	}
 
-	substitution := false
-	for _, part := range c.command {
-		if strings.Contains(part, c.subSymbol) {
-			substitution = true
-			break
+	var then [][]string
+	for _, s := range c.thenCommands {
+		command, err := shellquote.Split(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad --then command %q: %s", s, err)
 		}
+		if len(command) == 0 {
+			return nil, errors.New("--then command must not be empty")
+		}
+		then = append(then, command)
+	}
+	if len(then) > 0 && c.startService {
+		return nil, errors.New("cannot use --then with --start-service")
+	}
+	if c.continueOnError && len(then) == 0 {
+		return nil, errors.New("--continue-on-error requires --then")
+	}
+	allParts := append([]string(nil), c.command...)
+	for _, command := range then {
+		allParts = append(allParts, command...)
 	}
 
-	var backlog Backlog
-	if substitution {
-		if c.startService {
-			return nil, errors.New("using --start-service does not work with a command that has a substitution symbol")
+	// {N} is only treated as a substitution token if there is a regex with
+	// at least N capture groups.
+	groups := captureGroups(matcher)
+	matchTokens, groupTokens := 0, 0
+	substitution, countToken := false, false
+	if c.commandFormat {
+		var err error
+		substitution, countToken, err = checkCommandFormat(allParts)
+		if err != nil {
+			return nil, err
 		}
-		backlog = NewUniqueFilesBacklog()
 	} else {
+		for _, part := range allParts {
+			// An escaped symbol (see subEscape) is only a literal.
+			unescaped := strings.ReplaceAll(part, subEscape(c.subSymbol), "")
+			if strings.Contains(unescaped, c.subSymbol) {
+				substitution = true
+			}
+			for _, token := range namePartTokens {
+				if strings.Contains(part, token) {
+					substitution = true
+				}
+			}
+			if strings.Contains(part, batchCountToken) {
+				countToken = true
+			}
+			for _, m := range matchTokenRegexp.FindAllStringSubmatch(part, -1) {
+				n, err := strconv.Atoi(m[2])
+				if err != nil {
+					continue
+				}
+				if m[1] == "" {
+					if n > groups {
+						continue
+					}
+					if n > groupTokens {
+						groupTokens = n
+					}
+				} else if n > matchTokens {
+					matchTokens = n
+				}
+				substitution = true
+			}
+		}
+	}
+
+	if substitution && c.startService {
+		return nil, errors.New("using --start-service does not work with a command that has a substitution symbol")
+	}
+	if countToken && c.startService {
+		token := batchCountToken
+		if c.commandFormat {
+			token = "%n"
+		}
+		return nil, fmt.Errorf("cannot use %s with --start-service", token)
+	}
+	var shell string
+	if c.shell {
+		if shell = os.Getenv("SHELL"); shell == "" {
+			shell = "/bin/sh"
+		}
+	}
+	if c.runInNearest != "" && c.startService {
+		return nil, errors.New("cannot use --run-in-nearest with --start-service")
+	}
+	// Like a substitution, --stdin-file and --run-in-nearest make the
+	// command depend on which file changed.
+	perFile := substitution || (c.stdinFile && !c.startService) || c.runInNearest != ""
+	switch c.backlogOrder {
+	case "any", "latest":
+	case "fifo":
+		if !perFile || c.substituteFirst {
+			return nil, errors.New("--backlog-order=fifo only applies to commands that run once per changed file (as with {})")
+		}
+	default:
+		return nil, fmt.Errorf("bad --backlog-order %q (choices: any, fifo, latest)", c.backlogOrder)
+	}
+	var backlog Backlog
+	switch {
+	case c.backlogOrder == "latest":
+		backlog = NewLatestBacklog()
+	case perFile && !c.substituteFirst && c.backlogOrder == "fifo":
+		backlog = NewOrderedFilesBacklog()
+	case perFile && !c.substituteFirst:
+		backlog = NewUniqueFilesBacklog()
+	default:
 		backlog = NewUnifiedBacklog()
 	}
 
+	if c.noDefaultStart && !c.startService {
+		return nil, errors.New("--no-default-start requires --start-service")
+	}
+	if c.runAtStart && c.startService {
+		return nil, errors.New("--run-at-start cannot be used with --start-service (services start with reflex anyway)")
+	}
+	if c.runAtStart && (flagCount > 0 || flagWaitForOne) {
+		// The run at start would count as the awaited change.
+		return nil, errors.New("--run-at-start cannot be used with --count or --wait-for-one")
+	}
+	if c.watchBinary && !c.startService {
+		return nil, errors.New("--watch-binary requires --start-service")
+	}
+	if c.delay < 0 {
+		return nil, errors.New("--delay cannot be negative")
+	}
+	if c.maxRuntime < 0 {
+		return nil, errors.New("--max-runtime cannot be negative")
+	}
+	if c.maxRuntime > 0 && c.startService {
+		return nil, errors.New("--max-runtime cannot be used with --start-service")
+	}
+	var restartSig syscall.Signal
+	if c.minRestart < 0 {
+		return nil, errors.New("--min-restart-interval cannot be negative")
+	}
+	if c.minRestart > 0 && !c.startService {
+		return nil, errors.New("--min-restart-interval requires --start-service")
+	}
+	if c.restartSignal != "" {
+		if !c.startService {
+			return nil, errors.New("--restart-signal requires --start-service")
+		}
+		if c.watchBinary {
+			// A new executable needs a real restart.
+			return nil, errors.New("cannot use --restart-signal with --watch-binary")
+		}
+		var err error
+		if restartSig, err = parseSignal(c.restartSignal); err != nil {
+			return nil, fmt.Errorf("bad --restart-signal: %s", err)
+		}
+	}
+
+	var stopSig syscall.Signal
+	if c.stopSignal != "" {
+		var err error
+		if stopSig, err = parseSignal(c.stopSignal); err != nil {
+			return nil, fmt.Errorf("bad --stop-signal: %s", err)
+		}
+	}
+
 	if c.onlyFiles && c.onlyDirs {
 		return nil, errors.New("cannot specify both --only-files and --only-dirs")
 	}
+	if c.onlyExecutable && c.onlyDirs {
+		return nil, errors.New("cannot specify both --only-executable and --only-dirs")
+	}
+	if c.testMode && c.startService {
+		return nil, errors.New("cannot use --test-mode with --start-service")
+	}
+	if c.onlyDirs && !flagDirEvents {
+		return nil, errors.New("cannot use --only-dirs with --dir-events=false")
+	}
 
 	if c.shutdownTimeout <= 0 {
 		return nil, errors.New("shutdown timeout cannot be <= 0")
 	}
+	if c.debounce <= 0 {
+		return nil, errors.New("--debounce must be positive")
+	}
+	if c.maxLatency < 0 {
+		return nil, errors.New("--max-latency cannot be negative")
+	}
+	if c.debouncePerFile && (c.maxLatency > 0 || c.flushFirst || len(c.require) > 0) {
+		return nil, errors.New("cannot use --debounce-per-file with --max-latency, --flush-first, or --require")
+	}
+
+	var readyChecks int
+	for _, check := range []string{c.readyRegex, c.readyTCP, c.readyHTTP} {
+		if check != "" {
+			readyChecks++
+		}
+	}
+	if readyChecks > 0 && !c.startService {
+		return nil, errors.New("--ready-regex, --ready-tcp, and --ready-http require --start-service")
+	}
+	if readyChecks > 1 {
+		return nil, errors.New("only one of --ready-regex, --ready-tcp, and --ready-http may be given")
+	}
+	var readyRegex *regexp.Regexp
+	if c.readyRegex != "" {
+		readyRegex, err = regexp.Compile(c.readyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing --ready-regex: %s", err)
+		}
+	}
+	if c.readyTCP != "" {
+		if _, _, err := net.SplitHostPort(c.readyTCP); err != nil {
+			return nil, fmt.Errorf("bad --ready-tcp address: %s", err)
+		}
+	}
+	if c.readyHTTP != "" {
+		u, err := url.Parse(c.readyHTTP)
+		if err != nil {
+			return nil, fmt.Errorf("bad --ready-http URL: %s", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("bad --ready-http URL %q: must be http or https", c.readyHTTP)
+		}
+	}
+	if c.readyTimeout <= 0 {
+		return nil, errors.New("ready timeout cannot be <= 0")
+	}
+	if c.rawOutput && c.readyRegex != "" {
+		return nil, errors.New("cannot use --ready-regex with --raw-output")
+	}
+	if c.stdoutFile != "" && c.stderrFile != "" && c.readyRegex != "" {
+		return nil, errors.New("cannot use --ready-regex when both --stdout and --stderr are redirected")
+	}
+
+	for _, kv := range c.env {
+		if strings.Index(kv, "=") <= 0 {
+			return nil, fmt.Errorf("bad --env %q: not of the form KEY=VALUE", kv)
+		}
+	}
+	if c.envFile != "" {
+		// Catch mistakes early; the file is read again for each run.
+		if _, err := readEnvFile(c.envFile); err != nil {
+			return nil, fmt.Errorf("cannot read --env-file: %s", err)
+		}
+	}
 
 	reflex := &Reflex{
 		id:           reflexID,
 		source:       c.source,
+		name:         c.name,
 		startService: c.startService,
+		defaultStart: !c.noDefaultStart,
+		runAtStart:   c.runAtStart,
 		backlog:      backlog,
 		matcher:      matcher,
+		require:      require,
 		onlyFiles:    c.onlyFiles,
 		onlyDirs:     c.onlyDirs,
+		onlyExec:     c.onlyExecutable,
 		command:      c.command,
+		then:         then,
+		keepGoing:    c.continueOnError,
 		subSymbol:    c.subSymbol,
-		done:         make(chan struct{}),
+		cmdFormat:    c.commandFormat,
+		shell:        shell,
+		stdinFile:    c.stdinFile,
+		runInNearest: c.runInNearest,
+		stdoutFile:   c.stdoutFile,
+		stderrFile:   c.stderrFile,
+		envFile:      c.envFile,
+		env:          c.env,
+		matchTokens:  matchTokens,
+		groupTokens:  groupTokens,
+		countToken:   countToken,
+		readyRegex:   readyRegex,
+		readyTCP:     c.readyTCP,
+		readyHTTP:    c.readyHTTP,
+		readyTimeout: c.readyTimeout,
+		rawOutput:    c.rawOutput,
+		noPty:        c.noPty,
+		flushFirst:   c.flushFirst,
+		fileDebounce: c.debouncePerFile,
+		testMode:     c.testMode,
+		watchBinary:  c.watchBinary,
+		noGroupKill:  c.noGroupKill,
+		debounce:     c.debounce,
+		maxLatency:   c.maxLatency,
+		maxRuntime:   c.maxRuntime,
+		delay:        c.delay,
+		restartSig:   restartSig,
+		minRestart:   c.minRestart,
+		stopSig:      stopSig,
+		realpath:     c.matchRealpath,
 		timeout:      c.shutdownTimeout,
 		mu:           &sync.Mutex{},
+		retired:      make(chan struct{}),
+	}
+	if countToken {
+		reflex.counts = make(chan int)
 	}
 	reflexID++
 
 	return reflex, nil
 }
 
+// checkNames returns an error if two of reflexes have the same --name.
+func checkNames(reflexes []*Reflex) error {
+	sources := make(map[string]string)
+	for _, r := range reflexes {
+		if r.name == "" {
+			continue
+		}
+		if source, ok := sources[r.name]; ok {
+			return fmt.Errorf("--name %q is used by both %s and %s", r.name, source, r.source)
+		}
+		sources[r.name] = r.source
+	}
+	return nil
+}
+
 func (r *Reflex) String() string {
 	var buf bytes.Buffer
 	fmt.Fprintln(&buf, "Reflex from", r.source)
 	fmt.Fprintln(&buf, "| ID:", r.id)
+	if r.name != "" {
+		fmt.Fprintln(&buf, "| Name:", r.name)
+	}
 	for _, matcherInfo := range strings.Split(r.matcher.String(), "\n") {
 		fmt.Fprintln(&buf, "|", matcherInfo)
 	}
@@ -113,39 +502,197 @@ func (r *Reflex) String() string {
 	} else if r.onlyDirs {
 		fmt.Fprintln(&buf, "| Only matching directories.")
 	}
-	if !r.startService {
+	if r.onlyExec {
+		fmt.Fprintln(&buf, "| Only matching executable files.")
+	}
+	for _, m := range r.require {
+		fmt.Fprintf(&buf, "| Requiring a change matching %q in each batch.\n", m.glob)
+	}
+	placeholder := []string{subEscape(r.subSymbol), r.subSymbol, r.subSymbol, "<filename>"}
+	if r.cmdFormat {
+		fmt.Fprintln(&buf, "| Command format")
+		placeholder = []string{"%f", "<filename>"}
+	} else if !r.startService {
 		fmt.Fprintln(&buf, "| Substitution symbol", r.subSymbol)
 	}
-	replacer := strings.NewReplacer(r.subSymbol, "<filename>")
-	command := make([]string, len(r.command))
-	for i, part := range r.command {
-		command[i] = replacer.Replace(part)
+	if r.shell != "" {
+		fmt.Fprintln(&buf, "| Run by the shell", r.shell)
 	}
+	command := replaceSubSymbol(r.command, placeholder...)
 	fmt.Fprintln(&buf, "| Command:", command)
+	for _, then := range r.then {
+		fmt.Fprintln(&buf, "| Then:", replaceSubSymbol(then, placeholder...))
+	}
+	if r.keepGoing {
+		fmt.Fprintln(&buf, "| Continuing after errors.")
+	}
 	fmt.Fprintln(&buf, "+---------")
 	return buf.String()
 }
 
 // filterMatching passes on messages matching the regex/glob.
 func (r *Reflex) filterMatching(out chan<- string, in <-chan string) {
+	var realpaths realpathCaches
+	if r.realpath {
+		realpaths = make(realpathCaches)
+	}
 	for name := range in {
+		if name == "" {
+			// A manual trigger (SIGUSR1): run whatever the patterns
+			// say, as for --run-at-start.
+			if flagDryRun {
+				r.infoPrintf("manual trigger: would run %q", r.commandFor(name))
+				continue
+			}
+			if !r.send(out, name) {
+				return
+			}
+			continue
+		}
+		if realpaths != nil {
+			name = realpaths.resolve(name)
+		}
 		if !r.matcher.Match(name) {
+			if flagDryRun {
+				r.infoPrintf("%s: no match (rejected by %s)", name, rejectedBy(r.matcher, name))
+			}
 			continue
 		}
 
-		if r.onlyFiles || r.onlyDirs {
+		if r.onlyFiles || r.onlyDirs || r.onlyExec {
 			stat, err := os.Stat(name)
 			if err != nil {
+				if flagDryRun {
+					r.infoPrintf("%s: skipped (%s)", name, err)
+				}
 				continue
 			}
 			if (r.onlyFiles && stat.IsDir()) || (r.onlyDirs && !stat.IsDir()) {
+				if flagDryRun {
+					r.infoPrintf("%s: skipped by --only-files or --only-dirs", name)
+				}
+				continue
+			}
+			if r.onlyExec && (!stat.Mode().IsRegular() || stat.Mode()&0111 == 0) {
+				if flagDryRun {
+					r.infoPrintf("%s: skipped by --only-executable", name)
+				}
 				continue
 			}
 		}
-		out <- name
+		atomic.AddInt64(&eventsMatched, 1)
+		if flagDryRun {
+			r.infoPrintf("%s: matched; would run %q", name, r.commandFor(name))
+			continue
+		}
+		if !r.send(out, name) {
+			return
+		}
 	}
 }
 
+// send sends name to out unless r is retired first, and reports whether it
+// was sent.
+func (r *Reflex) send(out chan<- string, name string) bool {
+	select {
+	case out <- name:
+		return true
+	case <-r.retired:
+		return false
+	}
+}
+
+// sendCount sends n on r.counts (for {count}) unless r is retired first.
+func (r *Reflex) sendCount(n int) {
+	select {
+	case r.counts <- n:
+	case <-r.retired:
+	}
+}
+
+// realpathCaches holds a realpathCache for each watch root (as given), made
+// when the first name from that root needs resolving.
+type realpathCaches map[string]*realpathCache
+
+// resolve is like realpathCache.resolve for name as reported by any root (see
+// rootedName): a name that stays inside its root keeps the root in front.
+func (cs realpathCaches) resolve(name string) string {
+	root, rel := splitRoot(name)
+	c, ok := cs[root]
+	if !ok {
+		c = newRealpathCache(root)
+		cs[root] = c
+	}
+	resolved := c.resolve(rel)
+	if path.IsAbs(resolved) {
+		return resolved
+	}
+	return rootedName(root, resolved)
+}
+
+// A realpathCache resolves the symlinks in the names of changed files in one
+// watch root, for --match-realpath. It caches the resolved directories, so it
+// doesn't notice if a symlink to a directory is later pointed somewhere else.
+// Directories that can't be resolved (yet) aren't cached.
+type realpathCache struct {
+	root     string // the watch root, which names are relative to
+	realRoot string // root, resolved and absolute ("" until that succeeds)
+	dirs     map[string]string
+}
+
+func newRealpathCache(root string) *realpathCache {
+	return &realpathCache{root: root, dirs: make(map[string]string)}
+}
+
+// resolveDir returns the absolute path of dir with all symlinks resolved, or
+// "" if that fails.
+func (c *realpathCache) resolveDir(dir string) string {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return ""
+	}
+	abs, err := filepath.Abs(resolved)
+	if err != nil {
+		return ""
+	}
+	return abs
+}
+
+// resolve returns name (as from normalize) with its symlinks resolved: relative
+// to the root if it's inside it and absolute otherwise. If name can't be
+// resolved (say, because the file was removed), it is returned as is.
+func (c *realpathCache) resolve(name string) string {
+	dir := strings.HasSuffix(name, "/")
+	parent, base := path.Split(strings.TrimSuffix(name, "/"))
+	if c.realRoot == "" {
+		c.realRoot = c.resolveDir(c.root)
+	}
+	realParent, ok := c.dirs[parent]
+	if !ok {
+		realParent = c.resolveDir(filepath.Join(c.root, filepath.FromSlash(parent)))
+		if realParent != "" {
+			c.dirs[parent] = realParent
+		}
+	}
+	if realParent == "" || c.realRoot == "" {
+		return name
+	}
+	resolved := filepath.Join(realParent, base)
+	if stat, err := os.Lstat(resolved); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+		if target, err := filepath.EvalSymlinks(resolved); err == nil {
+			resolved = target
+		}
+	}
+	if rel, err := filepath.Rel(c.realRoot, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		resolved = rel
+	}
+	resolved = filepath.ToSlash(resolved)
+	if dir {
+		resolved += "/"
+	}
+	return resolved
+}
+
 // batch receives file notification events and batches them up. It's a bit
 // tricky, but here's what it accomplishes:
 // * When we initially get a message, wait a bit and batch messages before
@@ -153,29 +700,151 @@ func (r *Reflex) filterMatching(out chan<- string, in <-chan string) {
 // * Once it's time to send, don't do it until the out channel is unblocked.
 //   In the meantime, keep batching. When we've sent off all the batched
 //   messages, go back to the beginning.
+//
+// How long to wait is set by --debounce; each message restarts the wait.
+// With --max-latency, the batch is sent no later than that long after its
+// first message, even if messages keep arriving.
+//
+// With --flush-first, a message that arrives after a quiet period is sent
+// without waiting; the messages that follow it are batched as usual.
+//
+// With --require, a batch in which some --require glob wasn't matched is
+// dropped rather than sent.
+//
+// With --global-debounce, the wait is instead until no change has been
+// broadcast to any reflex for that long, so that the batches of all the
+// reflexes are sent together.
+//
+// With --debounce-per-file (and no --global-debounce), batchPerFile is used
+// instead.
 func (r *Reflex) batch(out chan<- string, in <-chan string) {
+	if r.fileDebounce && flagGlobalDebounce == 0 {
+		r.batchPerFile(out, in)
+		return
+	}
 
-	const silenceInterval = 300 * time.Millisecond
-
-	for name := range in {
+	var (
+		last   time.Time // when the last message arrived
+		start  time.Time // when the current batch started
+		events int       // the number of messages in the current batch
+	)
+	// The different names in the current batch, for {count}.
+	var unique map[string]struct{}
+	// Which of the --require globs have been matched in the current batch.
+	var required []bool
+	add := func(name string) {
+		last = time.Now()
+		events++
+		if r.countToken {
+			unique[name] = struct{}{}
+		}
+		for i, m := range r.require {
+			if m.Match(name) {
+				required[i] = true
+			}
+		}
 		r.backlog.Add(name)
-		timer := time.NewTimer(silenceInterval)
+		atomic.StoreInt64(&r.backlogLen, int64(r.backlog.Len()))
+	}
+	for {
+		var name string
+		var ok bool
+		select {
+		case name, ok = <-in:
+			if !ok {
+				return
+			}
+		case <-r.retired:
+			return
+		}
+		delay := r.debounce
+		if flagGlobalDebounce > 0 {
+			delay = globalQuiet()
+		} else if r.flushFirst && time.Since(last) > r.debounce {
+			delay = 0
+		}
+		start, events = time.Now(), 0
+		unique = make(map[string]struct{})
+		required = make([]bool, len(r.require))
+		add(name)
+		if verbose {
+			r.infoPrintln("Batch started by", name)
+		}
+		timer := time.NewTimer(delay)
+		// With --max-latency, once the deadline passes the batch is
+		// ready right away, however many messages are still coming.
+		var deadline <-chan time.Time
+		if r.maxLatency > 0 {
+			deadline = time.After(r.maxLatency)
+		}
+		overdue := false
 	outer:
 		for {
 			select {
+			case <-r.retired:
+				timer.Stop()
+				return
 			case name := <-in:
-				r.backlog.Add(name)
+				add(name)
+				if !timer.Stop() {
+					<-timer.C
+				}
+				switch {
+				case overdue:
+					timer.Reset(0)
+				case flagGlobalDebounce > 0:
+					timer.Reset(globalQuiet())
+				default:
+					timer.Reset(r.debounce)
+				}
+			case <-deadline:
+				if verbose {
+					r.infoPrintf("Batch reached --max-latency (%s)", r.maxLatency)
+				}
+				overdue = true
+				deadline = nil
 				if !timer.Stop() {
 					<-timer.C
 				}
-				timer.Reset(silenceInterval)
+				timer.Reset(0)
 			case <-timer.C:
+				// Another reflex may have seen a change since
+				// this timer was set.
+				if flagGlobalDebounce > 0 && !overdue && globalQuiet() > 0 {
+					timer.Reset(globalQuiet())
+					continue
+				}
+				if missing := r.missingRequired(required); missing != "" {
+					if verbose {
+						r.infoPrintf("Batch dropped: no change matched --require %q", missing)
+					}
+					for r.backlog.Len() > 0 {
+						r.backlog.RemoveOne()
+					}
+					atomic.StoreInt64(&r.backlogLen, 0)
+					break outer
+				}
+				if verbose {
+					r.infoPrintf("Batch ready after %s: %d events coalesced into %d to run",
+						time.Since(start).Round(time.Millisecond), events, r.backlog.Len())
+				}
 				for {
 					select {
+					case <-r.retired:
+						return
 					case name := <-in:
-						r.backlog.Add(name)
+						add(name)
 					case out <- r.backlog.Next():
-						if r.backlog.RemoveOne() {
+						if r.countToken {
+							r.sendCount(len(unique))
+						}
+						empty := r.backlog.RemoveOne()
+						atomic.StoreInt64(&r.backlogLen, int64(r.backlog.Len()))
+						if empty {
+							if verbose {
+								r.infoPrintf("Batch dispatched after %s (%d events in total)",
+									time.Since(start).Round(time.Millisecond), events)
+							}
 							break outer
 						}
 					}
@@ -185,68 +854,554 @@ func (r *Reflex) batch(out chan<- string, in <-chan string) {
 	}
 }
 
+// batchPerFile is like batch, but each name waits for --debounce on its own:
+// a name goes into the backlog once there have been no messages for it for
+// that long, however many messages for other names arrive in the meantime.
+// The backlog is sent as it fills, without waiting for a quiet period.
+func (r *Reflex) batchPerFile(out chan<- string, in <-chan string) {
+	// When each name that is still waiting is ready to go into the backlog.
+	waiting := make(map[string]time.Time)
+	// The different names added to the backlog since it was last empty,
+	// for {count}.
+	unique := make(map[string]struct{})
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		// Wake up when the next waiting name is ready.
+		var next time.Time
+		for _, ready := range waiting {
+			if next.IsZero() || ready.Before(next) {
+				next = ready
+			}
+		}
+		var timerC <-chan time.Time
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+			timerC = timer.C
+		}
+		var outC chan<- string
+		var name string
+		if r.backlog.Len() > 0 {
+			outC = out
+			name = r.backlog.Next()
+		}
+
+		select {
+		case <-r.retired:
+			timer.Stop()
+			return
+		case changed, ok := <-in:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			waiting[changed] = time.Now().Add(r.debounce)
+		case now := <-timerC:
+			timerC = nil
+			for waitingName, ready := range waiting {
+				if ready.After(now) {
+					continue
+				}
+				delete(waiting, waitingName)
+				if verbose {
+					r.infoPrintln("Ready after --debounce:", waitingName)
+				}
+				if r.countToken {
+					unique[waitingName] = struct{}{}
+				}
+				r.backlog.Add(waitingName)
+			}
+			atomic.StoreInt64(&r.backlogLen, int64(r.backlog.Len()))
+		case outC <- name:
+			if r.countToken {
+				r.sendCount(len(unique))
+			}
+			if r.backlog.RemoveOne() {
+				unique = make(map[string]struct{})
+			}
+			atomic.StoreInt64(&r.backlogLen, int64(r.backlog.Len()))
+		}
+		if timerC != nil && !timer.Stop() {
+			<-timer.C
+		}
+	}
+}
+
+// missingRequired returns the first of r's --require globs that isn't marked
+// as matched in required, or "" if they all are.
+func (r *Reflex) missingRequired(required []bool) string {
+	for i, matched := range required {
+		if !matched {
+			return r.require[i].glob
+		}
+	}
+	return ""
+}
+
+// globalQuiet returns how long is left until no change has been broadcast for
+// --global-debounce (or 0 if that's already the case).
+func globalQuiet() time.Duration {
+	last := time.Unix(0, atomic.LoadInt64(&lastChange))
+	if d := flagGlobalDebounce - time.Since(last); d > 0 {
+		return d
+	}
+	return 0
+}
+
 // runEach runs the command on each name that comes through the names channel.
 // Each {} is replaced by the name of the file. The output of the command is
 // passed line-by-line to the stdout chan.
 func (r *Reflex) runEach(names <-chan string) {
-	for name := range names {
+	for {
+		var name string
+		var ok bool
+		select {
+		case name, ok = <-names:
+			if !ok {
+				return
+			}
+		case <-r.retired:
+			return
+		}
+		if r.countToken {
+			select {
+			case r.count = <-r.counts:
+			case <-r.retired:
+				return
+			}
+		}
+		if r.delay > 0 {
+			if name = r.waitDelay(name, names); r.isRetired() {
+				return
+			}
+		}
 		if r.startService {
-			if r.Running() {
-				infoPrintln(r.id, "Killing service")
-				r.terminate()
+			r.restartService(name, stdout)
+		} else {
+			if len(r.command) > 0 {
+				last, ok := countRun()
+				if !ok {
+					// The --count limit was reached by another
+					// command; reflex is exiting.
+					return
+				}
+				r.runCommands(name, stdout)
+				if last {
+					countReachedOnce.Do(func() { close(countReached) })
+					return
+				}
 			}
-			infoPrintln(r.id, "Starting service")
-			r.runCommand(name, stdout)
+			if flagWaitForOne {
+				waitedForOneOnce.Do(func() { close(waitedForOne) })
+				return
+			}
+		}
+	}
+}
+
+// waitDelay waits for --delay before the command runs for name. For a service,
+// a name that comes through names in the meantime starts the wait over and
+// replaces name (as the service is only restarted once); waitDelay returns the
+// name to run with.
+func (r *Reflex) waitDelay(name string, names <-chan string) string {
+	if verbose {
+		r.infoPrintf("Waiting %s before running (--delay)", r.delay)
+	}
+	var more <-chan string
+	if r.startService {
+		more = names
+	}
+	timer := time.NewTimer(r.delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return name
+		case <-r.retired:
+			return name
+		case next, ok := <-more:
+			if !ok {
+				more = nil
+				continue
+			}
+			name = next
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(r.delay)
+		}
+	}
+}
+
+// restartService restarts the service or, with --restart-signal, signals it
+// to reload. A service that isn't running is started.
+func (r *Reflex) restartService(name string, stdout chan<- OutMsg) {
+	r.mu.Lock()
+	started := r.started
+	r.mu.Unlock()
+	// The service keeps running during the wait; meanwhile, batch
+	// collects any further changes for the next restart.
+	if wait := time.Until(started.Add(r.minRestart)); wait > 0 {
+		if verbose {
+			r.infoPrintf("Waiting %s to restart (--min-restart-interval)", wait.Round(time.Millisecond))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.retired:
+			timer.Stop()
+			return
+		}
+		// The service may have been stopped for good (by a reload or
+		// on exit) during the wait.
+		if r.isRetired() || r.Killed() {
+			return
+		}
+	}
+	if r.restartSig != 0 && r.reload() {
+		return
+	}
+	if r.Running() {
+		r.lifecyclePrintln("Killing service")
+		r.terminate()
+	}
+	r.lifecyclePrintln("Starting service")
+	if _, err := r.runCommand(name, stdout); err != nil && err != errRetired {
+		// Leave the service stopped; the next change will try to start
+		// it again.
+		r.infoPrintln("Error starting service:", err)
+	}
+}
+
+// reload sends the --restart-signal to the service, if it's running, and
+// reports whether it did. If the service turns out to have just exited,
+// reload waits for reflex to notice so that it can be started again.
+func (r *Reflex) reload() bool {
+	r.mu.Lock()
+	running, cmd, done := r.running, r.cmd, r.done
+	r.mu.Unlock()
+	if !running {
+		return false
+	}
+	if err := cmd.Process.Signal(r.restartSig); err != nil {
+		<-done
+		return false
+	}
+	r.infoPrintf("Reloaded via %s", signalName(r.restartSig))
+	return true
+}
+
+// countRun records a (non-service) run toward the --count limit. It reports
+// whether the run may go ahead and whether it is the last one allowed.
+func countRun() (last, ok bool) {
+	if flagCount <= 0 {
+		return false, true
+	}
+	n := atomic.AddInt64(&runsStarted, 1)
+	return n == int64(flagCount), n <= int64(flagCount)
+}
+
+// runCommands runs the command for name followed by the --then commands,
+// waiting for each to finish. It stops at the first command that fails unless
+// --continue-on-error is set.
+func (r *Reflex) runCommands(name string, stdout chan<- OutMsg) {
+	if r.testMode {
+		r.runTests(name, stdout)
+		return
+	}
+	r.runSequence(name, stdout)
+}
+
+// runSequence runs the commands for name as described for runCommands. It
+// reports whether they all succeeded and returns channels that are closed when
+// the output of each command that ran has been read.
+func (r *Reflex) runSequence(name string, stdout chan<- OutMsg) (ok bool, outputDone []<-chan struct{}) {
+	commands := [][]string{r.commandFor(name)}
+	for _, command := range r.then {
+		commands = append(commands, r.expand(command, name))
+	}
+	ok = true
+	for i, command := range commands {
+		done, err := r.startCommand(command, name, stdout)
+		if err == errRetired {
+			return false, outputDone
+		}
+		if err != nil {
+			r.infoPrintln("Error running command:", err)
 		} else {
-			r.runCommand(name, stdout)
-			<-r.done
 			r.mu.Lock()
-			r.running = false
+			outputDone = append(outputDone, r.scanned)
 			r.mu.Unlock()
+			<-done
+			err = r.exitError()
+			if r.Killed() {
+				// Stopped by reflex (for a restart, say, or on
+				// exit); the rest shouldn't run even with
+				// --continue-on-error.
+				return false, outputDone
+			}
+		}
+		if err != nil {
+			ok = false
+			if !r.keepGoing {
+				if i < len(commands)-1 {
+					r.infoPrintln("Skipping the remaining --then commands")
+				}
+				break
+			}
+		}
+	}
+	return ok, outputDone
+}
+
+// testOutputTimeout is how long runTests waits for the rest of the output
+// after the commands exit (which only matters if they leave behind some
+// process that holds the pty open).
+const testOutputTimeout = time.Second
+
+// runTests runs the commands for name like runCommands, but for --test-mode:
+// their output is held back and only printed if a command fails. Either way,
+// it's followed by a PASS or FAIL line.
+func (r *Reflex) runTests(name string, stdout chan<- OutMsg) {
+	var (
+		mu     sync.Mutex
+		output []OutMsg
+		// After deciding whether to show the output, any that arrives
+		// late is either passed through or discarded.
+		decided     bool
+		passThrough bool
+	)
+	buffered := make(chan OutMsg)
+	collected := make(chan struct{})
+	go func() {
+		for msg := range buffered {
+			mu.Lock()
+			switch {
+			case !decided:
+				output = append(output, msg)
+			case passThrough:
+				stdout <- msg
+			}
+			mu.Unlock()
+		}
+		close(collected)
+	}()
+
+	ok, outputDone := r.runSequence(name, buffered)
+	go func() {
+		for _, done := range outputDone {
+			<-done
 		}
+		close(buffered)
+	}()
+	select {
+	case <-collected:
+	case <-time.After(testOutputTimeout):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	decided = true
+	passThrough = !ok
+	if ok {
+		stdout <- OutMsg{reflexID: r.id, name: r.name, msg: "PASS", color: colorGreen, info: true}
+		return
+	}
+	for _, msg := range output {
+		stdout <- msg
 	}
+	stdout <- OutMsg{reflexID: r.id, name: r.name, msg: "FAIL (" + r.source + ")", color: colorRed, info: true}
 }
 
 func (r *Reflex) terminate() {
 	r.mu.Lock()
 	r.killed = true
+	done, cmd, tty := r.done, r.cmd, r.tty
 	r.mu.Unlock()
-	// Write ascii 3 (what you get from ^C) to the controlling pty.
-	// (This won't do anything if the process already died as the write will
-	// simply fail.)
-	r.tty.Write([]byte{3})
+	// Escalate to SIGINT and then SIGKILL. If the process still hasn't
+	// exited one timeout after SIGKILL (it may be stuck in uninterruptible
+	// sleep), give up on it rather than hang forever.
+	escalation := []syscall.Signal{syscall.SIGINT, syscall.SIGKILL, 0}
+	switch {
+	case r.stopSig != 0:
+		// Start with the --stop-signal and go straight to SIGKILL.
+		r.lifecyclePrintln(fmt.Sprintf("Sending %s signal...", signalName(r.stopSig)))
+		r.kill(cmd, r.stopSig)
+		escalation = escalation[1:]
+	case r.noGroupKill || tty == nil:
+		// A ^C would reach the whole foreground process group.
+		// (Without a pty, with --no-pty, there's nowhere to write
+		// one.) SIGINT has been sent, so escalate straight to SIGKILL.
+		r.lifecyclePrintln("Sending SIGINT signal...")
+		r.kill(cmd, syscall.SIGINT)
+		escalation = escalation[1:]
+	default:
+		// Write ascii 3 (what you get from ^C) to the controlling pty.
+		// (This won't do anything if the process already died as the
+		// write will simply fail.)
+		tty.Write([]byte{3})
+	}
 
 	timer := time.NewTimer(r.timeout)
-	sig := syscall.SIGINT
-	for {
+	defer timer.Stop()
+	for _, sig := range escalation {
 		select {
-		case <-r.done:
+		case <-done:
 			return
 		case <-timer.C:
-			if sig == syscall.SIGINT {
-				infoPrintln(r.id, "Sending SIGINT signal...")
-			} else {
-				infoPrintln(r.id, "Sending SIGKILL signal...")
-			}
+		}
+		if sig == 0 {
+			r.infoPrintf("Process did not exit %s after SIGKILL; giving up on it", r.timeout)
+			return
+		}
+		r.lifecyclePrintln(fmt.Sprintf("Sending %s signal...", signalName(sig)))
 
-			// Instead of killing the process, we want to kill its
-			// whole pgroup in order to clean up any children the
-			// process may have created.
-			if err := syscall.Kill(-1*r.cmd.Process.Pid, sig); err != nil {
-				infoPrintln(r.id, "Error killing:", err)
-				if err.(syscall.Errno) == syscall.ESRCH { // no such process
-					return
-				}
+		if err := r.kill(cmd, sig); err != nil {
+			r.infoPrintln("Error killing:", err)
+			if errors.Is(err, syscall.ESRCH) { // no such process
+				return
 			}
-			// After SIGINT doesn't do anything, try SIGKILL next.
-			timer.Reset(r.timeout)
-			sig = syscall.SIGKILL
 		}
+		timer.Reset(r.timeout)
+	}
+}
+
+// forceKill sends SIGKILL to the running command (and its process group), if
+// any, without waiting for it to exit.
+func (r *Reflex) forceKill() {
+	r.mu.Lock()
+	running, cmd := r.running, r.cmd
+	r.killed = true
+	r.mu.Unlock()
+	if running {
+		r.kill(cmd, syscall.SIGKILL)
+	}
+}
+
+// matchTokenRegexp matches the {match:N} substitution tokens, which are
+// replaced by the part of the filename matched by the Nth wildcard of a glob
+// or the Nth capture group of a regex, as well as the {N} tokens, which are
+// only for regexes' capture groups.
+var matchTokenRegexp = regexp.MustCompile(`\{(match:)?([1-9][0-9]*)\}`)
+
+// batchCountToken is replaced by the number of different files that changed in
+// the batch that the command runs for.
+const batchCountToken = "{count}"
+
+// namePartTokens are replaced by the directory, base name, and extension of
+// the changed file (see nameParts).
+var namePartTokens = []string{"{dir}", "{base}", "{ext}"}
+
+// nameParts splits name (as from normalize) into its directory ("." at the
+// top level), base name, and extension (including the dot, or "" if none).
+func nameParts(name string) (dir, base, ext string) {
+	file := strings.TrimSuffix(name, "/")
+	return path.Dir(file), path.Base(file), path.Ext(file)
+}
+
+// nameEnv returns the environment variables that tell a command about the
+// changed file name: REFLEX_FILENAME (like {}) and REFLEX_DIR (like {dir}).
+// They are empty if there is no name (as when a service first starts).
+func nameEnv(name string) []string {
+	var dir string
+	if name != "" {
+		dir, _, _ = nameParts(name)
 	}
+	return []string{"REFLEX_FILENAME=" + name, "REFLEX_DIR=" + dir}
 }
 
-func replaceSubSymbol(command []string, subSymbol string, name string) []string {
-	replacer := strings.NewReplacer(subSymbol, name)
+// commandFor returns the command to run for a change to name.
+func (r *Reflex) commandFor(name string) []string {
+	if r.startService {
+		// Services are started without a name (and NewReflex rejects
+		// service commands containing substitution tokens), so the
+		// command is always run as given, but for escaped symbols.
+		return r.shellWrap(replaceSubSymbol(r.command, subEscape(r.subSymbol), r.subSymbol))
+	}
+	return r.substitute(name)
+}
+
+// substitute returns r's command with the substitutions for name applied.
+func (r *Reflex) substitute(name string) []string {
+	return r.expand(r.command, name)
+}
+
+// expand returns command (r's command or one of its --then commands) with the
+// substitutions for name applied.
+func (r *Reflex) expand(command []string, name string) []string {
+	if r.cmdFormat {
+		return r.shellWrap(expandCommandFormat(command, name, r.count, r.shell != ""))
+	}
+	return r.shellWrap(replaceSubSymbol(command, r.substitutions(name)...))
+}
+
+// nthSubmatch returns the Nth (from 1) of subs, or "" if there are fewer.
+func nthSubmatch(subs []string, n int) string {
+	if n > len(subs) {
+		return ""
+	}
+	return subs[n-1]
+}
+
+// shellWrap returns command as it is run: with --shell, joined into a single
+// string and run by the shell; otherwise, unchanged.
+func (r *Reflex) shellWrap(command []string) []string {
+	if r.shell == "" {
+		return command
+	}
+	return []string{r.shell, "-c", strings.Join(command, " ")}
+}
+
+// substitutions returns the substitutions for name as old, new pairs for
+// replaceSubSymbol.
+func (r *Reflex) substitutions(name string) []string {
+	dir, base, ext := nameParts(name)
+	oldnew := []string{
+		r.subSymbol, name,
+		namePartTokens[0], dir,
+		namePartTokens[1], base,
+		namePartTokens[2], ext,
+	}
+	if r.countToken {
+		oldnew = append(oldnew, batchCountToken, strconv.Itoa(r.count))
+	}
+	if r.matchTokens > 0 {
+		subs := submatches(r.matcher, name)
+		for i := 1; i <= r.matchTokens; i++ {
+			oldnew = append(oldnew, fmt.Sprintf("{match:%d}", i), nthSubmatch(subs, i))
+		}
+	}
+	if r.groupTokens > 0 {
+		// Only regexes' groups, as with captureGroups.
+		subs := groupSubmatches(r.matcher, name)
+		for i := 1; i <= r.groupTokens; i++ {
+			oldnew = append(oldnew, fmt.Sprintf("{%d}", i), nthSubmatch(subs, i))
+		}
+	}
+	if r.shell != "" {
+		// The command is interpreted by the shell, so the values
+		// must be quoted.
+		for i := 1; i < len(oldnew); i += 2 {
+			oldnew[i] = shellquote.Join(oldnew[i])
+		}
+	}
+	// The escape comes first so that it takes precedence over the symbol
+	// inside it.
+	return append([]string{subEscape(r.subSymbol), r.subSymbol}, oldnew...)
+}
+
+// subEscape returns the escaped form of the substitution symbol sym, which is
+// replaced by sym itself rather than a filename: the symbol in braces, as in
+// {{}} for a literal {}.
+func subEscape(sym string) string {
+	return "{" + sym + "}"
+}
+
+// replaceSubSymbol replaces each old string with the corresponding new string
+// (given as old, new pairs, as for strings.NewReplacer) in every part of
+// command. All replacements happen in a single pass.
+func replaceSubSymbol(command []string, oldnew ...string) []string {
+	replacer := strings.NewReplacer(oldnew...)
 	newCommand := make([]string, len(command))
 	for i, c := range command {
 		newCommand[i] = replacer.Replace(c)
@@ -256,87 +1411,580 @@ func replaceSubSymbol(command []string, subSymbol string, name string) []string
 
 var seqCommands = &sync.Mutex{}
 
-// runCommand runs the given Command. All output is passed line-by-line to the
-// stdout channel.
-func (r *Reflex) runCommand(name string, stdout chan<- OutMsg) {
-	command := replaceSubSymbol(r.command, r.subSymbol, name)
+// errRetired is returned by startCommand for a reflex that has been retired.
+var errRetired = errors.New("the command was replaced by a reload of the config file")
+
+// runCommand runs the command for name. All output is passed line-by-line to
+// the stdout channel. The returned channel is closed when the command exits.
+func (r *Reflex) runCommand(name string, stdout chan<- OutMsg) (<-chan struct{}, error) {
+	return r.startCommand(r.commandFor(name), name, stdout)
+}
+
+// startCommand is like runCommand, but runs the given command. (The name is
+// still needed for --stdin-file.)
+func (r *Reflex) startCommand(command []string, name string, stdout chan<- OutMsg) (<-chan struct{}, error) {
 	cmd := exec.Command(command[0], command[1:]...)
-	r.cmd = cmd
+	cmd.Env = append(os.Environ(), nameEnv(name)...)
+	if r.envFile != "" {
+		env, err := readEnvFile(r.envFile)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	// --env settings override the --env-file.
+	cmd.Env = append(cmd.Env, r.env...)
+	if r.runInNearest != "" {
+		dir, err := nearestDir(".", name, r.runInNearest)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Dir = dir
+	}
+	// In each case below, the child's copy of the file is all that's
+	// needed once it has started.
+	if r.stdinFile {
+		stdin, err := openStdinFile(name)
+		if err != nil {
+			return nil, err
+		}
+		defer stdin.Close()
+		cmd.Stdin = stdin
+	}
+	if r.stdoutFile != "" {
+		f, err := openOutputFile(r.stdoutFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		cmd.Stdout = f
+	}
+	if r.stderrFile != "" {
+		if r.stderrFile == r.stdoutFile {
+			cmd.Stderr = cmd.Stdout
+		} else {
+			f, err := openOutputFile(r.stderrFile)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			cmd.Stderr = f
+		}
+	}
 
-	if flagSequential {
+	// Read --sequential once, so the lock is released just as it was
+	// taken.
+	sequential := flagSequential
+	if sequential {
 		seqCommands.Lock()
 	}
 
-	tty, err := pty.Start(cmd)
+	// r.mu is held from checking that r isn't retired until the command
+	// is marked as running, so that retire either stops the command
+	// from being started or sees it running (and terminates it).
+	r.mu.Lock()
+	var tty *os.File // nil with --no-pty
+	var outputs []outputStream
+	var err error
+	switch {
+	case r.isRetired():
+		err = errRetired
+	case r.noPty || !havePty:
+		outputs, err = startWithPipes(cmd)
+	default:
+		tty, err = startWithPty(cmd)
+		outputs = []outputStream{{r: tty}}
+	}
 	if err != nil {
-		infoPrintln(r.id, err)
-		return
+		r.mu.Unlock()
+		if sequential {
+			seqCommands.Unlock()
+		}
+		return nil, err
 	}
+	outputDone := make(chan struct{})
+	done := make(chan struct{})
+	r.running = true
+	r.killed = false
+	r.timedOut = false
+	r.ready = false
+	r.exitErr = nil
+	r.started = time.Now()
+	r.done = done
+	r.scanned = outputDone
+	r.cmd = cmd
 	r.tty = tty
+	r.mu.Unlock()
+	atomic.AddInt64(&commandsRun, 1)
+
+	stopResize := func() {}
+	if tty != nil {
+		stopResize = resizePty(tty)
+	}
 
-	// Handle pty size.
-	chResize := make(chan os.Signal, 1)
-	signal.Notify(chResize, syscall.SIGWINCH)
+	var outputWG sync.WaitGroup
+	for _, output := range outputs {
+		outputWG.Add(1)
+		go func(output outputStream) {
+			if r.rawOutput {
+				r.copyRaw(output.r, output.stderr, stdout)
+			} else {
+				r.scanLines(output.r, output.stderr, stdout)
+			}
+			// All the output has been read, so the pty (or pipe)
+			// is done with.
+			output.r.Close()
+			outputWG.Done()
+		}(output)
+	}
 	go func() {
-		for range chResize {
-			// Intentionally ignore errors in case stdout is not a tty
-			pty.InheritSize(os.Stdout, tty)
+		outputWG.Wait()
+		if flagDedupOutput {
+			// Let the printer end any run of repeated lines.
+			stdout <- OutMsg{reflexID: r.id, name: r.name, end: true}
 		}
+		close(outputDone)
 	}()
-	chResize <- syscall.SIGWINCH // Initial resize.
 
 	go func() {
-		scanner := bufio.NewScanner(tty)
-		// Allow for lines up to 100 MB.
-		scanner.Buffer(nil, 100e6)
-		for scanner.Scan() {
-			stdout <- OutMsg{r.id, scanner.Text()}
-		}
-		if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
-			infoPrintln(r.id, "Error: subprocess emitted a line longer than 100 MB")
-		}
-		// Intentionally ignore other scanner errors. Unfortunately,
-		// the pty returns a read error when the child dies naturally,
-		// so I'm just going to ignore errors here unless I can find a
-		// better way to handle it.
+		err := cmd.Wait()
+		r.mu.Lock()
+		timedOut := r.timedOut
+		r.mu.Unlock()
+		if timedOut {
+			// Unlike a command that reflex stops on purpose, one
+			// that runs too long has failed.
+			err = fmt.Errorf("ran longer than --max-runtime (%s)", r.maxRuntime)
+		}
+		if !r.Killed() && err != nil {
+			stdout <- OutMsg{reflexID: r.id, name: r.name, msg: fmt.Sprintf("(error exit: %s)", err), info: true}
+		}
+		if !r.startService && !r.Killed() {
+			atomic.StoreInt64(&lastExitStatus, int64(exitStatus(err)))
+		}
+		r.mu.Lock()
+		r.running = false
+		r.exitErr = err
+		r.mu.Unlock()
+		close(done)
+
+		stopResize()
+
+		if sequential {
+			seqCommands.Unlock()
+		}
 	}()
 
+	if r.readyTCP != "" || r.readyHTTP != "" {
+		go r.waitReady(done)
+	}
+	if r.maxRuntime > 0 {
+		go r.limitRuntime(done)
+	}
+	return done, nil
+}
+
+// limitRuntime stops the command that closes done when it exits if it's still
+// running after --max-runtime.
+func (r *Reflex) limitRuntime(done <-chan struct{}) {
+	timer := time.NewTimer(r.maxRuntime)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
 	r.mu.Lock()
-	r.running = true
+	current := r.done == done && !r.killed
+	if current {
+		r.timedOut = true
+	}
 	r.mu.Unlock()
-	go func() {
-		err := cmd.Wait()
-		if !r.Killed() && err != nil {
-			stdout <- OutMsg{r.id, fmt.Sprintf("(error exit: %s)", err)}
+	if !current {
+		return
+	}
+	r.infoPrintf("Command ran for longer than --max-runtime (%s); stopping it", r.maxRuntime)
+	r.terminate()
+}
+
+// An outputStream is a source of a command's output: its pty or, with
+// --no-pty, the pipe for its stdout or stderr.
+type outputStream struct {
+	r      io.ReadCloser
+	stderr bool // r is the command's stderr
+}
+
+// startWithPipes starts cmd, for --no-pty, with pipes for stdout and stderr
+// (unless they're already set) and returns the ends of the pipes to read the
+// output from. Its stdin, unless already set, is empty. Like with a pty, the
+// command gets a session (and process group) of its own.
+func startWithPipes(cmd *exec.Cmd) ([]outputStream, error) {
+	var outputs []outputStream
+	var writers []*os.File
+	closeWriters := func() {
+		for _, w := range writers {
+			w.Close()
+		}
+	}
+	closeReaders := func() {
+		for _, output := range outputs {
+			output.r.Close()
+		}
+	}
+	for _, stream := range []struct {
+		w      *io.Writer
+		stderr bool
+	}{
+		{&cmd.Stdout, false},
+		{&cmd.Stderr, true},
+	} {
+		if *stream.w != nil {
+			continue
 		}
-		r.done <- struct{}{}
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			closeWriters()
+			closeReaders()
+			return nil, err
+		}
+		*stream.w = pw
+		writers = append(writers, pw)
+		outputs = append(outputs, outputStream{r: pr, stderr: stream.stderr})
+	}
+	setSession(cmd)
+	err := cmd.Start()
+	// The child has its own copies of the writers.
+	closeWriters()
+	if err != nil {
+		closeReaders()
+		return nil, err
+	}
+	return outputs, nil
+}
 
-		signal.Stop(chResize)
-		close(chResize)
+// exitStatus returns the exit status, as a shell would report it, for a
+// command that exited with err (from cmd.Wait): 128 plus the signal number if
+// it was killed by a signal, or 1 if it didn't exit normally at all.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
 
-		if flagSequential {
-			seqCommands.Unlock()
+const readyPollInterval = 100 * time.Millisecond
+
+var readyClient = &http.Client{Timeout: time.Second}
+
+// openStdinFile opens the file called name to be a command's standard input
+// for --stdin-file. If there is no name (as when starting a service), the
+// input is empty.
+func openStdinFile(name string) (*os.File, error) {
+	if name == "" {
+		return os.Open(os.DevNull)
+	}
+	return os.Open(name)
+}
+
+// nearestDir returns the closest directory to name (a changed path, as from
+// rootedName, with the current directory at base) that contains a file called
+// file, for --run-in-nearest. The search starts at name itself if it's a
+// directory, or else at the directory it's in, and stops at the watch root
+// that name is in.
+func nearestDir(base, name, file string) (string, error) {
+	root, rel := splitRoot(name)
+	rootDir := filepath.FromSlash(root)
+	if !filepath.IsAbs(rootDir) {
+		rootDir = filepath.Join(base, rootDir)
+	}
+	dir := strings.TrimSuffix(rel, "/")
+	if !strings.HasSuffix(rel, "/") {
+		dir = path.Dir(dir)
+	}
+	for {
+		candidate := filepath.Join(rootDir, filepath.FromSlash(dir))
+		if _, err := os.Stat(filepath.Join(candidate, file)); err == nil {
+			return candidate, nil
 		}
+		if dir == "." || dir == "/" {
+			return "", fmt.Errorf("no %s in any directory containing %s", file, name)
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// openOutputFile opens (creating it if necessary) the file called name for
+// appending a command's output, for --stdout and --stderr.
+func openOutputFile(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// scanLines sends each line of the command output read from tty to stdout
+// (marked as from stderr, if it is). When stdout isn't keeping up, the lines
+// that pile up in the meantime are sent together, as a single message with the
+// lines separated by newlines.
+func (r *Reflex) scanLines(tty io.Reader, stderr bool, stdout chan<- OutMsg) {
+	lines := make(chan string, maxLinesPerMsg)
+	sent := make(chan struct{})
+	go func() {
+		r.sendLines(lines, stderr, stdout)
+		close(sent)
 	}()
+	scanner := bufio.NewScanner(tty)
+	// Allow for lines up to 100 MB.
+	scanner.Buffer(nil, 100e6)
+	for scanner.Scan() {
+		lines <- scanner.Text()
+	}
+	close(lines)
+	<-sent
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		r.infoPrintln("Error: subprocess emitted a line longer than 100 MB")
+	}
+	// Intentionally ignore other scanner errors. Unfortunately,
+	// the pty returns a read error when the child dies naturally,
+	// so I'm just going to ignore errors here unless I can find a
+	// better way to handle it.
+}
+
+// maxLinesPerMsg is the most lines of output that scanLines puts in a message.
+const maxLinesPerMsg = 1000
+
+// sendLines sends the lines from scanLines to stdout, coalescing them while
+// stdout is blocked, and prints "Service ready" after sending the first line
+// that matches --ready-regex.
+func (r *Reflex) sendLines(lines <-chan string, stderr bool, stdout chan<- OutMsg) {
+	// With --no-pty, stdout and stderr each have a sendLines, and either
+	// may see the line that matches first.
+	ready := r.readyRegex == nil
+	for line := range lines {
+		batch := []string{line}
+		var b strings.Builder
+		b.WriteString(line)
+		sent := false
+		select {
+		case stdout <- OutMsg{reflexID: r.id, name: r.name, msg: line, stderr: stderr}:
+			sent = true
+		default:
+		}
+	gather:
+		for !sent && len(batch) < maxLinesPerMsg {
+			select {
+			case stdout <- OutMsg{reflexID: r.id, name: r.name, msg: b.String(), stderr: stderr}:
+				sent = true
+			case line, ok := <-lines:
+				if !ok {
+					break gather
+				}
+				batch = append(batch, line)
+				b.WriteString("\n")
+				b.WriteString(line)
+			}
+		}
+		if !sent {
+			stdout <- OutMsg{reflexID: r.id, name: r.name, msg: b.String(), stderr: stderr}
+		}
+		if !ready {
+			for _, line := range batch {
+				if r.readyRegex.MatchString(line) {
+					ready = true
+					r.markReady()
+					break
+				}
+			}
+		}
+	}
+}
+
+// copyRaw sends the command output read from tty to stdout in chunks, as it
+// arrives, for --raw-output. Unlike scanLines, it doesn't wait for a newline,
+// so in-place updates using \r (progress bars and the like) work.
+func (r *Reflex) copyRaw(tty io.Reader, stderr bool, stdout chan<- OutMsg) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := tty.Read(buf)
+		if n > 0 {
+			stdout <- OutMsg{reflexID: r.id, name: r.name, msg: string(buf[:n]), raw: true, stderr: stderr}
+		}
+		if err != nil {
+			// As in scanLines, a read error is expected when the
+			// child exits.
+			return
+		}
+	}
+}
+
+// waitReady polls the service's --ready-tcp or --ready-http endpoint until it
+// responds, the service exits, or the ready timeout elapses.
+func (r *Reflex) waitReady(exited <-chan struct{}) {
+	deadline := time.NewTimer(r.readyTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		if r.probeReady() {
+			r.markReady()
+			return
+		}
+		select {
+		case <-exited:
+			return
+		case <-deadline.C:
+			r.infoPrintf("Service not ready after %s", r.readyTimeout)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// markReady prints "Service ready" unless it has already been printed for the
+// current run.
+func (r *Reflex) markReady() {
+	r.mu.Lock()
+	already := r.ready
+	r.ready = true
+	r.mu.Unlock()
+	if !already {
+		r.lifecyclePrintln("Service ready")
+	}
+}
+
+// probeReady makes a single attempt to reach the service's --ready-tcp or
+// --ready-http endpoint.
+func (r *Reflex) probeReady() bool {
+	if r.readyTCP != "" {
+		conn, err := net.DialTimeout("tcp", r.readyTCP, time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	resp, err := readyClient.Get(r.readyHTTP)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
 }
 
 func (r *Reflex) Start(changes <-chan string) {
+	if flagDryRun {
+		// Only report what matches; nothing is run.
+		go r.filterMatching(nil, changes)
+		return
+	}
 	filtered := make(chan string)
 	batched := make(chan string)
 	go r.filterMatching(filtered, changes)
+	if r.watchBinary {
+		path, err := exec.LookPath(r.command[0])
+		if err != nil {
+			r.infoPrintln("Cannot watch the service executable:", err)
+		} else {
+			go r.pollBinary(path, filtered)
+		}
+	}
 	go r.batch(batched, filtered)
-	go r.runEach(batched)
-	if r.startService {
+	r.stopped = make(chan struct{})
+	go func() {
+		r.runEach(batched)
+		close(r.stopped)
+	}()
+	if r.runAtStart {
+		// Like a matching change to a file with an empty name, so {}
+		// is replaced by nothing.
+		go r.send(filtered, "")
+	}
+	if r.startService && r.defaultStart {
 		// Easy hack to kick off the initial start.
-		infoPrintln(r.id, "Starting service")
-		r.runCommand("", stdout)
+		r.lifecyclePrintln("Starting service")
+		if _, err := r.runCommand("", stdout); err != nil {
+			r.infoPrintln("Error starting service:", err)
+		}
 	}
 }
 
+// binaryPollInterval is how often pollBinary checks the executable.
+var binaryPollInterval = time.Second
+
+// pollBinary watches the executable at path, for --watch-binary. When it
+// changes, pollBinary sends "" to out (as a manual trigger does) so that the
+// service is restarted; the executable isn't a changed file in the watched
+// tree. It returns when r is retired.
+func (r *Reflex) pollBinary(path string, out chan<- string) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(binaryPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.retired:
+			return
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			// The executable may be in the middle of being
+			// replaced; check again next time.
+			continue
+		}
+		if last != nil && stat.ModTime().Equal(last.ModTime()) && stat.Size() == last.Size() {
+			continue
+		}
+		last = stat
+		r.infoPrintln("Service executable changed:", path)
+		if !r.send(out, "") {
+			return
+		}
+	}
+}
+
+// retire stops r for good when a reload of the config file replaces it: no
+// more commands are run and the running one, if any, is terminated. It returns
+// once runEach has returned, so that nothing more can be started.
+func (r *Reflex) retire() {
+	// Once retired is closed, startCommand (which checks it while
+	// holding r.mu) starts nothing; a command it started just before is
+	// already marked as running.
+	close(r.retired)
+	if r.Running() {
+		r.terminate()
+	}
+	if r.stopped != nil {
+		<-r.stopped
+	}
+}
+
+func (r *Reflex) isRetired() bool {
+	select {
+	case <-r.retired:
+		return true
+	default:
+		return false
+	}
+}
+
+// Killed reports whether reflex stopped the current (or last) command on
+// purpose, for a restart or on exit. A command stopped for running over
+// --max-runtime doesn't count: it failed.
 func (r *Reflex) Killed() bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.killed
+	return r.killed && !r.timedOut
+}
+
+// exitError returns the error (if any) from the last command to exit.
+func (r *Reflex) exitError() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.exitErr
 }
 
 func (r *Reflex) Running() bool {
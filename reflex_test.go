@@ -0,0 +1,1693 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	flag "github.com/ogier/pflag"
+)
+
+func TestMain(m *testing.M) {
+	// Discard command output and info messages.
+	go func() {
+		for range stdout {
+		}
+	}()
+	os.Exit(m.Run())
+}
+
+// newTestReflex makes a Reflex from args, which are given as they would be in
+// a config file line.
+func newTestReflex(t testing.TB, args ...string) *Reflex {
+	t.Helper()
+	c := &Config{source: "test"}
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	c.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	c.command = flags.Args()
+	r, err := NewReflex(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRunCommand(t *testing.T) {
+	r := newTestReflex(t, "--", "true")
+	done, err := r.runCommand("", stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command did not finish")
+	}
+	if r.Running() {
+		t.Error("Running() is true after the command exited")
+	}
+}
+
+func TestRunCommandRawOutput(t *testing.T) {
+	r := newTestReflex(t, "--raw-output", "--", "printf", `10%%\r50%%\r100%%\n`)
+	out := make(chan OutMsg, 100)
+	done, err := r.runCommand("", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	var got strings.Builder
+	timeout := time.After(5 * time.Second)
+	// The output may arrive after the command exits.
+	for !strings.HasSuffix(got.String(), "\n") {
+		select {
+		case msg := <-out:
+			if !msg.raw {
+				t.Fatalf("got non-raw message %q", msg.msg)
+			}
+			got.WriteString(msg.msg)
+		case <-timeout:
+			t.Fatalf("timed out waiting for output; got %q", got.String())
+		}
+	}
+	// The pty translates \n to \r\n.
+	if want := "10%\r50%\r100%\r\n"; got.String() != want {
+		t.Errorf("got output %q; want %q", got.String(), want)
+	}
+}
+
+func TestRunCommandCoalescesOutput(t *testing.T) {
+	const n = 5000
+	r := newTestReflex(t, "--", "seq", strconv.Itoa(n))
+	out := make(chan OutMsg)
+	done, err := r.runCommand("", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let the output back up.
+	time.Sleep(100 * time.Millisecond)
+	var msgs, lines []string
+	for len(lines) < n {
+		select {
+		case msg := <-out:
+			msgs = append(msgs, msg.msg)
+			lines = append(lines, strings.Split(msg.msg, "\n")...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d lines of output; want %d", len(lines), n)
+		}
+	}
+	<-done
+	for i, line := range lines {
+		if want := strconv.Itoa(i + 1); line != want {
+			t.Fatalf("line %d of output is %q; want %q", i, line, want)
+		}
+	}
+	if len(msgs) == n {
+		t.Errorf("got a message for each of the %d lines; want them coalesced", n)
+	}
+}
+
+func BenchmarkRunCommandOutput(b *testing.B) {
+	r := newTestReflex(b, "--", "seq", "50000")
+	out := make(chan OutMsg, 1)
+	go printOutput(out, ioutil.Discard)
+	defer close(out)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		done, err := r.runCommand("", out)
+		if err != nil {
+			b.Fatal(err)
+		}
+		<-done
+		r.mu.Lock()
+		scanned := r.scanned
+		r.mu.Unlock()
+		<-scanned
+	}
+}
+
+func TestRunCommandStdinFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("hello from stdin\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{f.Name(), "[hello from stdin]"},
+		{"", "[]"},
+	} {
+		r := newTestReflex(t, "--stdin-file", "--", "sh", "-c", `echo "[$(cat)]"`)
+		out := make(chan OutMsg, 10)
+		done, err := r.runCommand(tt.name, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-out:
+			if msg.msg != tt.want {
+				t.Errorf("runCommand(%q) with --stdin-file: got output %q; want %q", tt.name, msg.msg, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("runCommand(%q) with --stdin-file: no output", tt.name)
+		}
+		<-done
+	}
+}
+
+func TestRunCommandEnvFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	r := newTestReflex(t, "--env-file="+f.Name(), "--", "sh", "-c", `echo "[$GREETING]"`)
+	for _, val := range []string{"one", "two"} {
+		// The same reflex reads the file again for each run.
+		if err := ioutil.WriteFile(f.Name(), []byte("GREETING="+val+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out := make(chan OutMsg, 10)
+		done, err := r.runCommand("", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "[" + val + "]"
+		select {
+		case msg := <-out:
+			if msg.msg != want {
+				t.Errorf("runCommand with --env-file: got output %q; want %q", msg.msg, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("runCommand with --env-file: no output")
+		}
+		<-done
+	}
+}
+
+func TestRunCommandEnv(t *testing.T) {
+	f, err := ioutil.TempFile("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("GREETING=file\nNAME=file\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r := newTestReflex(t, "--env-file="+f.Name(), "--env=GREETING=hi", "--env=EMPTY=", "--env=X=a=b",
+		"--", "sh", "-c", `echo "[$GREETING $NAME $EMPTY $X]"`)
+	out := make(chan OutMsg, 10)
+	done, err := r.runCommand("", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[hi file  a=b]"
+	select {
+	case msg := <-out:
+		if msg.msg != want {
+			t.Errorf("runCommand with --env: got output %q; want %q", msg.msg, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runCommand with --env: no output")
+	}
+	<-done
+}
+
+func TestRunCommandNoPty(t *testing.T) {
+	script := `if [ -t 1 ]; then echo tty; else echo pipe; fi; echo err >&2`
+	// The output is mapped to whether it came from stderr. (The two
+	// pipes are read separately, so the lines may come in either order.)
+	for _, tt := range []struct {
+		args []string
+		want map[string]bool
+	}{
+		{nil, map[string]bool{"tty": false, "err": false}},
+		{[]string{"--no-pty"}, map[string]bool{"pipe": false, "err": true}},
+	} {
+		args := append(tt.args, "--", "sh", "-c", script)
+		r := newTestReflex(t, args...)
+		out := make(chan OutMsg, 10)
+		done, err := r.runCommand("", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		<-r.scanned
+		close(out)
+		got := make(map[string]bool)
+		for msg := range out {
+			got[msg.msg] = msg.stderr
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("runCommand with %q: got output %v; want %v", tt.args, got, tt.want)
+		}
+	}
+
+	// Without a pty, terminate interrupts the command with a signal.
+	r := newTestReflex(t, "-s", "--no-pty", "--", "sleep", "10")
+	out := make(chan OutMsg, 10)
+	done, err := r.runCommand("", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	r.terminate()
+	<-done
+	if elapsed := time.Since(start); elapsed >= r.timeout {
+		t.Errorf("terminate with --no-pty took %s; want the first signal to stop it", elapsed)
+	}
+}
+
+func TestRunCommandShell(t *testing.T) {
+	defer os.Setenv("SHELL", os.Getenv("SHELL"))
+	os.Setenv("SHELL", "")
+
+	r := newTestReflex(t, "-S", "--", "echo", "[{}]", "&&", "echo", "{base}", "|", "tr", "a-z", "A-Z")
+	name := "dir/it's $HOME;.txt"
+	want := []string{"/bin/sh", "-c", `echo ['dir/it'\''s $HOME;.txt'] && echo 'it'\''s $HOME;.txt' | tr a-z A-Z`}
+	if got := r.substitute(name); !reflect.DeepEqual(got, want) {
+		t.Errorf("substitute: got %q; want %q", got, want)
+	}
+
+	out := make(chan OutMsg, 10)
+	if _, err := r.runCommand(name, out); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for len(lines) < 2 {
+		select {
+		case msg := <-out:
+			lines = append(lines, strings.Split(msg.msg, "\n")...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("runCommand with --shell: got output %q; want 2 lines", lines)
+		}
+	}
+	wantLines := []string{"[dir/it's $HOME;.txt]", "IT'S $HOME;.TXT"}
+	if !reflect.DeepEqual(lines, wantLines) {
+		t.Errorf("runCommand with --shell: got output %q; want %q", lines, wantLines)
+	}
+}
+
+func TestRunCommandsThen(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{
+			[]string{"--then=echo second {}", "--then=echo third", "--", "echo", "first"},
+			[]string{"first", "second a.go", "third"},
+		},
+		{
+			[]string{"--then=echo second", "--", "false"},
+			nil,
+		},
+		{
+			[]string{"--then=false", "--then=echo third", "--continue-on-error", "--", "echo", "first"},
+			[]string{"first", "third"},
+		},
+	} {
+		r := newTestReflex(t, tt.args...)
+		out := make(chan OutMsg, 100)
+		r.runCommands("a.go", out)
+		// Output may still be arriving after the last command exits.
+		var got []string
+	collect:
+		for {
+			select {
+			case msg := <-out:
+				if !strings.HasPrefix(msg.msg, "(error exit") {
+					got = append(got, msg.msg)
+				}
+			case <-time.After(200 * time.Millisecond):
+				break collect
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got output %q; want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRunCommandsThenKilled(t *testing.T) {
+	r := newTestReflex(t, "--then=echo second", "--continue-on-error", "--shutdown-timeout=100ms", "--", "sleep", "10")
+	out := make(chan OutMsg, 100)
+	finished := make(chan struct{})
+	go func() {
+		r.runCommands("", out)
+		close(finished)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !r.Running() {
+		if time.Now().After(deadline) {
+			t.Fatal("the command did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.terminate()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runCommands did not return after the command was killed")
+	}
+	if r.Running() {
+		t.Error("a --then command was started after the command was killed")
+	}
+	for len(out) > 0 {
+		if msg := <-out; msg.msg == "second" {
+			t.Error("the --then command ran after the command was killed")
+		}
+	}
+}
+
+func TestRunCommandOutputFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stdoutFile := filepath.Join(dir, "stdout")
+	stderrFile := filepath.Join(dir, "stderr")
+
+	r := newTestReflex(t, "--stdout="+stdoutFile, "--stderr="+stderrFile, "--",
+		"sh", "-c", "echo out; echo err >&2; echo tty > /dev/tty")
+	out := make(chan OutMsg, 10)
+	for i := 0; i < 2; i++ {
+		done, err := r.runCommand("", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+	}
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{stdoutFile, "out\nout\n"},
+		{stderrFile, "err\nerr\n"},
+	} {
+		b, err := ioutil.ReadFile(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s: got %q; want %q", filepath.Base(tt.name), b, tt.want)
+		}
+	}
+	// The pty is still the controlling terminal.
+	select {
+	case msg := <-out:
+		if msg.msg != "tty" {
+			t.Errorf("got output %q; want %q", msg.msg, "tty")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no output from /dev/tty")
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	for _, tt := range []struct {
+		command string
+		want    []string
+	}{
+		{"echo some output; true", []string{"PASS"}},
+		{"echo some output; false", []string{"(error exit: exit status 1)", "some output", "FAIL (test)"}},
+	} {
+		r := newTestReflex(t, "--test-mode", "--", "sh", "-c", tt.command)
+		out := make(chan OutMsg, 100)
+		r.runCommands("", out)
+		// Let the command and its output finish before reading what
+		// was printed; out is drained rather than closed, since
+		// runTests may still pass on output that arrives late.
+		r.mu.Lock()
+		done, scanned := r.done, r.scanned
+		r.mu.Unlock()
+		<-done
+		<-scanned
+		var got []string
+		for len(out) > 0 {
+			got = append(got, (<-out).msg)
+		}
+		// The error exit message may come before or after the
+		// command's output, so only the last line's position is fixed.
+		if len(got) > 0 {
+			sort.Strings(got[:len(got)-1])
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q with --test-mode: got output %q; want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestRunCommandStartFailure(t *testing.T) {
+	defer func(sequential bool) { flagSequential = sequential }(flagSequential)
+	flagSequential = true
+
+	r := newTestReflex(t, "--", "/nonexistent/command")
+	// Start twice: if the first failure leaked the --sequential lock, the
+	// second attempt hangs.
+	for i := 0; i < 2; i++ {
+		errc := make(chan error)
+		go func() {
+			_, err := r.runCommand("", stdout)
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			if err == nil {
+				t.Fatal("runCommand: got nil error for a nonexistent command")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("runCommand hung after a failed start")
+		}
+		if r.Running() {
+			t.Fatal("Running() is true after a failed start")
+		}
+	}
+}
+
+func TestTerminateSignalIgnoringChild(t *testing.T) {
+	r := newTestReflex(t, "--shutdown-timeout=50ms", "--",
+		"sh", "-c", "trap '' INT; echo started; sleep 10")
+	done, err := r.runCommand("", stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give the shell a moment to install its trap.
+	time.Sleep(100 * time.Millisecond)
+	terminated := make(chan struct{})
+	go func() {
+		r.terminate()
+		close(terminated)
+	}()
+	select {
+	case <-terminated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("terminate did not return")
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("terminate returned before the command exited")
+	}
+}
+
+func TestTerminateNoProcessGroupKill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, groupKill := range []bool{true, false} {
+		// The shell and its child both ignore SIGINT (and SIGHUP,
+		// which the child gets when the shell, its session leader,
+		// dies), so only SIGKILL stops them. The child creates a file
+		// if it survives.
+		file := filepath.Join(dir, fmt.Sprintf("survived-%t", groupKill))
+		args := []string{"--shutdown-timeout=50ms", "--",
+			"sh", "-c", "trap '' INT HUP; (sleep 0.3; touch " + file + ") & echo started; wait"}
+		if !groupKill {
+			args = append([]string{"--no-process-group-kill"}, args...)
+		}
+		r := newTestReflex(t, args...)
+		out := make(chan OutMsg, 10)
+		done, err := r.runCommand("", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-out:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no output from command")
+		}
+		r.terminate()
+		<-done
+		time.Sleep(500 * time.Millisecond)
+		_, err = os.Stat(file)
+		if survived := err == nil; survived == groupKill {
+			t.Errorf("with process group kill %t: child survived: %t", groupKill, survived)
+		}
+	}
+}
+
+func TestRestartServiceSignal(t *testing.T) {
+	r := newTestReflex(t, "-s", "--restart-signal=SIGHUP", "--",
+		"sh", "-c", `trap 'echo reloaded' HUP; echo started; while true; do sleep 0.05; done`)
+	out := make(chan OutMsg, 10)
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case msg := <-out:
+			if msg.msg != want {
+				t.Fatalf("got output %q; want %q", msg.msg, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no output; want %q", want)
+		}
+	}
+	pid := func() int {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.cmd.Process.Pid
+	}
+
+	// Not running: the service is started.
+	r.restartService("", out)
+	expect("started")
+	first := pid()
+
+	// Running: the service is signaled, not restarted.
+	r.restartService("", out)
+	expect("reloaded")
+	if pid() != first {
+		t.Error("service was restarted rather than signaled")
+	}
+
+	// Died: the service is started again.
+	r.mu.Lock()
+	done, cmd := r.done, r.cmd
+	r.mu.Unlock()
+	r.kill(cmd, syscall.SIGKILL)
+	<-done
+	expect("(error exit: signal: killed)")
+	r.restartService("", out)
+	expect("started")
+	if pid() == first {
+		t.Error("dead service was not started again")
+	}
+	r.terminate()
+}
+
+func TestRestartServiceMinInterval(t *testing.T) {
+	r := newTestReflex(t, "-s", "--min-restart-interval=300ms", "--", "sleep", "10")
+	defer r.terminate()
+	out := make(chan OutMsg, 10)
+	restart := func() time.Duration {
+		start := time.Now()
+		r.restartService("", out)
+		return time.Since(start)
+	}
+
+	restart()
+	// Too soon: the restart waits out the interval.
+	if elapsed := restart(); elapsed < 250*time.Millisecond {
+		t.Errorf("second restart took %s; want it to wait for about 300ms", elapsed)
+	}
+	// After the interval: the restart happens right away.
+	time.Sleep(400 * time.Millisecond)
+	if elapsed := restart(); elapsed > 200*time.Millisecond {
+		t.Errorf("restart after the interval took %s; want it to be immediate", elapsed)
+	}
+
+	// Retiring the reflex during the wait cancels the restart.
+	restarted := make(chan time.Duration)
+	go func() { restarted <- restart() }()
+	time.Sleep(50 * time.Millisecond)
+	r.retire()
+	if elapsed := <-restarted; elapsed > 200*time.Millisecond {
+		t.Errorf("restart after retire took %s; want it to stop waiting", elapsed)
+	}
+	if r.Running() {
+		t.Error("the service was started again after retire")
+	}
+}
+
+func TestMaxRuntime(t *testing.T) {
+	defer func(status int64) { lastExitStatus = status }(lastExitStatus)
+	atomic.StoreInt64(&lastExitStatus, 0)
+
+	r := newTestReflex(t, "--max-runtime=100ms", "--then=echo then", "--", "sleep", "10")
+	out := make(chan OutMsg, 10)
+	start := time.Now()
+	ok, outputDone := r.runSequence("", out)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runSequence with --max-runtime took %s", elapsed)
+	}
+	if ok {
+		t.Error("runSequence with --max-runtime: the stopped command counted as a success")
+	}
+	for _, done := range outputDone {
+		<-done
+	}
+	close(out)
+	var reported bool
+	for msg := range out {
+		if msg.msg == "then" {
+			t.Error("the --then command ran after the command was stopped")
+		}
+		if strings.Contains(msg.msg, "--max-runtime") && strings.HasPrefix(msg.msg, "(error exit") {
+			reported = true
+		}
+	}
+	if !reported {
+		t.Error("the stopped command was not reported as an error exit")
+	}
+	if status := atomic.LoadInt64(&lastExitStatus); status == 0 {
+		t.Error("the stopped command did not set a failing exit status")
+	}
+
+	// A command that finishes in time isn't affected.
+	r = newTestReflex(t, "--max-runtime=5s", "--", "true")
+	if ok, _ := r.runSequence("", make(chan OutMsg, 10)); !ok {
+		t.Error("runSequence with a command that finished within --max-runtime: got failure")
+	}
+}
+
+func TestMaxRuntimeStopSignal(t *testing.T) {
+	defer func(status int64) { lastExitStatus = status }(lastExitStatus)
+
+	// A command stopped by --max-runtime gets --stop-signal, not ^C.
+	r := newTestReflex(t, "--max-runtime=100ms", "--stop-signal=SIGTERM", "--",
+		"sh", "-c", "trap 'echo got TERM; exit 1' TERM; while :; do sleep 0.05; done")
+	out := make(chan OutMsg, 10)
+	_, outputDone := r.runSequence("", out)
+	for _, done := range outputDone {
+		<-done
+	}
+	close(out)
+	var got bool
+	for msg := range out {
+		if msg.msg == "got TERM" {
+			got = true
+		}
+	}
+	if !got {
+		t.Error("the command stopped by --max-runtime did not get --stop-signal")
+	}
+}
+
+func TestWaitDelay(t *testing.T) {
+	for _, tt := range []struct {
+		args     []string
+		want     string
+		min, max time.Duration
+	}{
+		// A command waits for the delay and isn't affected by the
+		// next change.
+		{[]string{"--delay=100ms", "echo"}, "a", 100 * time.Millisecond, 300 * time.Millisecond},
+		// For a service, the change at 50ms starts the delay over.
+		{[]string{"-s", "--delay=100ms", "echo"}, "b", 150 * time.Millisecond, 300 * time.Millisecond},
+	} {
+		r := newTestReflex(t, tt.args...)
+		names := make(chan string)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			select {
+			case names <- "b":
+			case <-time.After(time.Second):
+			}
+		}()
+		start := time.Now()
+		got := r.waitDelay("a", names)
+		elapsed := time.Since(start)
+		if got != tt.want {
+			t.Errorf("%q: got name %q; want %q", tt.args, got, tt.want)
+		}
+		if elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("%q: waited %s; want between %s and %s", tt.args, elapsed, tt.min, tt.max)
+		}
+	}
+}
+
+func TestTerminateNoPtyTimeout(t *testing.T) {
+	// Without a pty, SIGINT is sent right away, so a command that ignores
+	// it gets SIGKILL after one timeout, not two.
+	const timeout = 300 * time.Millisecond
+	r := newTestReflex(t, "--no-pty", "--shutdown-timeout="+timeout.String(), "--",
+		"sh", "-c", "trap '' INT; echo started; sleep 10")
+	out := make(chan OutMsg, 10)
+	done, err := r.runCommand("", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-out:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output from command")
+	}
+	start := time.Now()
+	r.terminate()
+	<-done
+	if elapsed := time.Since(start); elapsed >= timeout*5/3 {
+		t.Errorf("terminate took %s; want about one --shutdown-timeout (%s)", elapsed, timeout)
+	}
+}
+
+func TestTerminateStopSignal(t *testing.T) {
+	script := "trap 'echo got TERM; exit 0' TERM; echo ready; while true; do sleep 0.05; done"
+	r := newTestReflex(t, "--stop-signal=SIGTERM", "--", "sh", "-c", script)
+	out := make(chan OutMsg, 10)
+	outputDone, err := r.runCommand("", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	collect := func(want string) {
+		for {
+			select {
+			case msg := <-out:
+				lines = append(lines, strings.Split(msg.msg, "\n")...)
+				if lines[len(lines)-1] == want {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got output %q; want it to end with %q", lines, want)
+			}
+		}
+	}
+	collect("ready")
+	r.terminate()
+	<-outputDone
+	collect("got TERM")
+}
+
+func TestTerminateGivesUp(t *testing.T) {
+	// Simulate a process that never exits: done is never closed. The
+	// process itself is killed by SIGKILL and left as an unreaped zombie.
+	cmd := exec.Command("sleep", "10")
+	setSession(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+
+	r := newTestReflex(t, "--shutdown-timeout=50ms", "--", "true")
+	r.running = true
+	r.done = make(chan struct{})
+	r.cmd = cmd
+	r.tty = devNull
+	terminated := make(chan struct{})
+	go func() {
+		r.terminate()
+		close(terminated)
+	}()
+	select {
+	case <-terminated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("terminate did not give up on a process that never exits")
+	}
+}
+
+func TestBatchFlushFirst(t *testing.T) {
+	for _, tt := range []struct {
+		args      []string
+		wantFirst time.Duration // upper bound for the first change
+	}{
+		{[]string{"echo"}, time.Second},
+		{[]string{"--flush-first", "echo"}, 100 * time.Millisecond},
+	} {
+		r := newTestReflex(t, tt.args...)
+		in := make(chan string)
+		out := make(chan string)
+		go r.batch(out, in)
+
+		start := time.Now()
+		in <- "a"
+		<-out
+		if elapsed := time.Since(start); elapsed > tt.wantFirst {
+			t.Errorf("%q: first change took %s; want <= %s", tt.args, elapsed, tt.wantFirst)
+		}
+		// A change right after the first one is batched as usual.
+		start = time.Now()
+		in <- "b"
+		<-out
+		if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+			t.Errorf("%q: second change took %s; want it to be batched", tt.args, elapsed)
+		}
+		close(in)
+	}
+}
+
+func TestBatchDebounceMaxLatency(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		// Changes every 50ms keep a 100ms debounce waiting until they
+		// stop (after 500ms).
+		{[]string{"--debounce=100ms", "echo"}, 550 * time.Millisecond, time.Second},
+		// The max latency cuts that short.
+		{[]string{"--debounce=100ms", "--max-latency=200ms", "echo"}, 150 * time.Millisecond, 400 * time.Millisecond},
+	} {
+		r := newTestReflex(t, tt.args...)
+		in := make(chan string)
+		out := make(chan string)
+		go r.batch(out, in)
+
+		start := time.Now()
+		dispatched := make(chan time.Duration, 1)
+		go func() {
+			<-out
+			dispatched <- time.Since(start)
+		}()
+		for i := 0; i < 10; i++ {
+			in <- "a"
+			time.Sleep(50 * time.Millisecond)
+		}
+		elapsed := <-dispatched
+		if elapsed < tt.wantMin || elapsed > tt.wantMax {
+			t.Errorf("%q: batch dispatched after %s; want between %s and %s", tt.args, elapsed, tt.wantMin, tt.wantMax)
+		}
+		close(in)
+	}
+}
+
+func TestBatchPerFile(t *testing.T) {
+	r := newTestReflex(t, "--debounce=100ms", "--debounce-per-file", "echo", "{}")
+	in := make(chan string)
+	out := make(chan string)
+	go r.batch(out, in)
+
+	start := time.Now()
+	type dispatch struct {
+		name    string
+		elapsed time.Duration
+	}
+	dispatched := make(chan dispatch, 10)
+	go func() {
+		for name := range out {
+			dispatched <- dispatch{name, time.Since(start)}
+		}
+	}()
+	// A change to main.go is run after its own debounce, though app.log
+	// changes every 50ms until 500ms have passed.
+	in <- "main.go"
+	for i := 0; i < 10; i++ {
+		in <- "app.log"
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, want := range []struct {
+		name     string
+		min, max time.Duration
+	}{
+		{"main.go", 100 * time.Millisecond, 300 * time.Millisecond},
+		{"app.log", 550 * time.Millisecond, time.Second},
+	} {
+		select {
+		case got := <-dispatched:
+			if got.name != want.name || got.elapsed < want.min || got.elapsed > want.max {
+				t.Errorf("got %s after %s; want %s after between %s and %s",
+					got.name, got.elapsed, want.name, want.min, want.max)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s was not dispatched", want.name)
+		}
+	}
+	close(in)
+}
+
+func TestBatchGlobalDebounce(t *testing.T) {
+	defer func(d time.Duration) { flagGlobalDebounce = d }(flagGlobalDebounce)
+	flagGlobalDebounce = 150 * time.Millisecond
+
+	r1 := newTestReflex(t, "--debounce=10ms", "echo")
+	r2 := newTestReflex(t, "--debounce=50ms", "echo")
+	changes := make(chan string)
+	outs := []chan string{make(chan string), make(chan string)}
+	go broadcast(func() ([]*Reflex, []chan string) { return []*Reflex{r1, r2}, outs }, changes)
+	defer close(changes)
+
+	// r1 sees every change; r2 only sees the first one (as if the others
+	// didn't match its patterns). Both should still wait for the whole
+	// burst to end.
+	in1, in2 := make(chan string), make(chan string)
+	go func() {
+		for name := range outs[0] {
+			in1 <- name
+		}
+	}()
+	go func() {
+		first := true
+		for name := range outs[1] {
+			if first {
+				in2 <- name
+				first = false
+			}
+		}
+	}()
+	out1, out2 := make(chan string), make(chan string)
+	go r1.batch(out1, in1)
+	go r2.batch(out2, in2)
+
+	start := time.Now()
+	dispatched := make(chan time.Duration, 2)
+	for _, out := range []chan string{out1, out2} {
+		go func(out chan string) {
+			<-out
+			dispatched <- time.Since(start)
+		}(out)
+	}
+	for i := 0; i < 3; i++ {
+		changes <- "a"
+		time.Sleep(100 * time.Millisecond)
+	}
+	// The last change was at 200ms, so the batches are ready at 350ms.
+	for i := 0; i < 2; i++ {
+		elapsed := <-dispatched
+		if min, max := 340*time.Millisecond, 700*time.Millisecond; elapsed < min || elapsed > max {
+			t.Errorf("batch dispatched after %s; want between %s and %s", elapsed, min, max)
+		}
+	}
+}
+
+func TestBatchRequire(t *testing.T) {
+	r := newTestReflex(t, "--debounce=50ms", "--require=*.proto", "--require=*.yaml", "--", "make")
+	in := make(chan string)
+	out := make(chan string, 1)
+	go r.batch(out, in)
+	defer close(in)
+
+	// A batch with only one of the required kinds of file is dropped.
+	in <- "a.proto"
+	in <- "b.go"
+	select {
+	case name := <-out:
+		t.Fatalf("got %q from a batch without a .yaml file", name)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := atomic.LoadInt64(&r.backlogLen); n != 0 {
+		t.Errorf("got %d paths left in the backlog after dropping the batch; want 0", n)
+	}
+
+	in <- "c.yaml"
+	in <- "a.proto"
+	select {
+	case <-out:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch with every required kind of file not sent")
+	}
+}
+
+func TestBatchCount(t *testing.T) {
+	r := newTestReflex(t, "--debounce=50ms", "-g", "*.go", "--", "echo", "{count}")
+	in := make(chan string)
+	out := make(chan string)
+	go r.batch(out, in)
+	defer close(in)
+
+	for _, tt := range []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"a.go", "b.go", "a.go"}, "2"},
+		{[]string{"c.go"}, "1"},
+	} {
+		for _, name := range tt.names {
+			in <- name
+		}
+		name := <-out
+		r.count = <-r.counts
+		want := []string{"echo", tt.want}
+		if got := r.commandFor(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("after changes to %q: got command %q; want %q", tt.names, got, want)
+		}
+	}
+}
+
+func TestRealpathCacheResolve(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "reflex-realpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	outside, err := ioutil.TempDir("", "reflex-realpath-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	realOutside, err := filepath.EvalSymlinks(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(tmpdir, "real/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"real/a.go", "real/sub/b.go", "c.go"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpdir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"link":     "real",
+		"d.go":     "c.go",
+		"external": outside,
+	} {
+		if err := os.Symlink(target, filepath.Join(tmpdir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newRealpathCache(tmpdir)
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"c.go", "c.go"},
+		{"real/a.go", "real/a.go"},
+		{"link/a.go", "real/a.go"},
+		{"link/sub/b.go", "real/sub/b.go"},
+		{"link/sub/", "real/sub/"},
+		{"link/missing.go", "real/missing.go"},
+		{"d.go", "c.go"},
+		{"external/e.go", filepath.ToSlash(filepath.Join(realOutside, "e.go"))},
+		{"gone/f.go", "gone/f.go"},
+	} {
+		if got := c.resolve(tt.name); got != tt.want {
+			t.Errorf("resolve(%q): got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// A directory that couldn't be resolved is tried again.
+	if err := os.Symlink("real", filepath.Join(tmpdir, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.resolve("gone/f.go"), "real/f.go"; got != want {
+		t.Errorf("resolve(%q) once the directory exists: got %q; want %q", "gone/f.go", got, want)
+	}
+
+	// Names from a --watch-dir root are resolved within that root.
+	defer func(dirs map[string]bool) { watchDirs = dirs }(watchDirs)
+	watchDirs = map[string]bool{tmpdir: true}
+	cs := make(realpathCaches)
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"c.go", "c.go"},
+		{rootedName(tmpdir, "link/a.go"), rootedName(tmpdir, "real/a.go")},
+		{rootedName(tmpdir, "external/e.go"), filepath.ToSlash(filepath.Join(realOutside, "e.go"))},
+	} {
+		if got := cs.resolve(tt.name); got != tt.want {
+			t.Errorf("resolve(%q) with --watch-dir: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunEachWaitForOne(t *testing.T) {
+	defer func(wait bool, ch chan struct{}) {
+		flagWaitForOne = wait
+		waitedForOne = ch
+		waitedForOneOnce = sync.Once{}
+	}(flagWaitForOne, waitedForOne)
+	flagWaitForOne = true
+
+	for _, args := range [][]string{
+		{"-g", "*.go"},
+		{"-g", "*.go", "--", "true"},
+	} {
+		waitedForOne = make(chan struct{})
+		waitedForOneOnce = sync.Once{}
+		r := newTestReflex(t, args...)
+		names := make(chan string)
+		returned := make(chan struct{})
+		go func() {
+			r.runEach(names)
+			close(returned)
+		}()
+		names <- "main.go"
+		select {
+		case <-waitedForOne:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: waitedForOne not closed after the first change", args)
+		}
+		select {
+		case <-returned:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: runEach did not return after the first change", args)
+		}
+	}
+}
+
+func TestRunEachCount(t *testing.T) {
+	defer func(count int, ch chan struct{}) {
+		flagCount = count
+		countReached = ch
+		countReachedOnce = sync.Once{}
+		runsStarted = 0
+	}(flagCount, countReached)
+	flagCount = 2
+	countReached = make(chan struct{})
+
+	r := newTestReflex(t, "-g", "*.go", "--", "true")
+	names := make(chan string)
+	returned := make(chan struct{})
+	go func() {
+		r.runEach(names)
+		close(returned)
+	}()
+	names <- "a.go"
+	select {
+	case <-countReached:
+		t.Fatal("countReached closed after the first run")
+	case <-time.After(50 * time.Millisecond):
+	}
+	names <- "b.go"
+	select {
+	case <-countReached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("countReached not closed after the second run")
+	}
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runEach did not return after the last run")
+	}
+	if _, ok := countRun(); ok {
+		t.Error("countRun allowed a run past the limit")
+	}
+}
+
+func TestStartRunAtStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stdoutFile := filepath.Join(dir, "stdout")
+
+	r := newTestReflex(t, "--run-at-start", "--debounce=10ms", "--stdout="+stdoutFile, "--", "echo", "[{}]")
+	r.Start(make(chan string))
+	defer r.retire()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(stdoutFile)
+		if got := string(b); got == "[]\n" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("--run-at-start: got output %q; want %q", got, "[]\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunAtStartWithCount(t *testing.T) {
+	defer func(count int, wait bool) {
+		flagCount, flagWaitForOne = count, wait
+	}(flagCount, flagWaitForOne)
+
+	for _, set := range []func(){
+		func() { flagCount, flagWaitForOne = 1, false },
+		func() { flagCount, flagWaitForOne = 0, true },
+	} {
+		set()
+		configs, err := readConfigsFromReader(strings.NewReader("--run-at-start -- true"), "test input")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewReflex(configs[0])
+		if err == nil || !strings.Contains(err.Error(), "--run-at-start") {
+			t.Errorf("--run-at-start with --count=%d --wait-for-one=%t: got error %v; want one about --run-at-start",
+				flagCount, flagWaitForOne, err)
+		}
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	for _, tt := range []struct {
+		command string
+		want    int
+	}{
+		{"true", 0},
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + int(syscall.SIGTERM)},
+	} {
+		err := exec.Command("sh", "-c", tt.command).Run()
+		if got := exitStatus(err); got != tt.want {
+			t.Errorf("exitStatus after %q: got %d; want %d", tt.command, got, tt.want)
+		}
+	}
+	if got := exitStatus(errors.New("could not start")); got != 1 {
+		t.Errorf("exitStatus(non-exit error): got %d; want 1", got)
+	}
+}
+
+func TestPollBinary(t *testing.T) {
+	defer func(d time.Duration) { binaryPollInterval = d }(binaryPollInterval)
+	binaryPollInterval = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "server")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestReflex(t, "-s", "--watch-binary", "--", path)
+	out := make(chan string)
+	go r.pollBinary(path, out)
+	defer r.retire()
+	select {
+	case name := <-out:
+		t.Fatalf("got change %q before the executable changed", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\necho v2\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-out:
+		if name != "" {
+			t.Errorf("got change %q; want \"\" (a manual trigger)", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change reported after the executable changed")
+	}
+}
+
+func TestProbeReady(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	r := newTestReflex(t, "-s", "--ready-tcp="+addr, "--", "true")
+	if !r.probeReady() {
+		t.Errorf("probeReady: got false with a listener on %s", addr)
+	}
+	ln.Close()
+	if r.probeReady() {
+		t.Errorf("probeReady: got true after closing the listener on %s", addr)
+	}
+
+	status := http.StatusServiceUnavailable
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	r = newTestReflex(t, "-s", "--ready-http="+ts.URL, "--", "true")
+	if r.probeReady() {
+		t.Error("probeReady: got true for a 503 response")
+	}
+	status = http.StatusOK
+	if !r.probeReady() {
+		t.Error("probeReady: got false for a 200 response")
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	r := newTestReflex(t, "-g", "proto/*/*.proto", "--",
+		"protoc", "-I", "proto/{match:1}", "--out=gen/{match:1}/{match:2}", "{match:3}", "{}")
+	got := r.substitute("proto/foo/bar.proto")
+	want := []string{"protoc", "-I", "proto/foo", "--out=gen/foo/bar", "", "proto/foo/bar.proto"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("substitute: got %q; want %q", got, want)
+	}
+}
+
+func TestSubstituteEscape(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"echo", "{{}}", "{}"}, []string{"echo", "{}", "a.go"}},
+		{[]string{"echo", "x{{}}y", "{}{}"}, []string{"echo", "x{}y", "a.goa.go"}},
+		{[]string{"--substitute=@@", "echo", "{@@}", "@@"}, []string{"echo", "@@", "a.go"}},
+	} {
+		r := newTestReflex(t, tt.args...)
+		if got := r.substitute("a.go"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("substitute for %q: got %q; want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// In shell mode the escape is replaced after quoting the file name.
+	r := newTestReflex(t, "-S", "echo {{}} {}")
+	got := r.substitute("a.go")
+	if want := "echo {} a.go"; got[len(got)-1] != want {
+		t.Errorf("substitute in shell mode: got %q; want last argument %q", got, want)
+	}
+}
+
+func TestSubstituteGroups(t *testing.T) {
+	r := newTestReflex(t, "-r", `^cmd/(\w+)/(\w+)\.go$`, "--",
+		"sh", "-c", "go build -o bin/{1} ./cmd/{1} && grep -E 'x{3}' {2}.go")
+	got := r.substitute("cmd/server/main.go")
+	want := []string{"sh", "-c", "go build -o bin/server ./cmd/server && grep -E 'x{3}' main.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("substitute: got %q; want %q", got, want)
+	}
+	if _, ok := r.backlog.(*UniqueFilesBacklog); !ok {
+		t.Errorf("got backlog %T; want *UniqueFilesBacklog", r.backlog)
+	}
+
+	// {N} is only filled from regexes, not from the wildcards of a glob.
+	r = newTestReflex(t, "-g", "docs/*.md", "-r", `^cmd/(\w+)/`, "--", "echo", "{1}", "{match:1}")
+	if got, want := r.substitute("docs/intro.md"), []string{"echo", "", "intro"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("substitute with a glob and a regex: got %q; want %q", got, want)
+	}
+
+	// Without capture groups, {N} is not a substitution token.
+	r = newTestReflex(t, "-r", `\.go$`, "--", "grep", "-E", "x{1}")
+	if got, want := r.substitute("main.go"), []string{"grep", "-E", "x{1}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("substitute: got %q; want %q", got, want)
+	}
+	if _, ok := r.backlog.(*UnifiedBacklog); !ok {
+		t.Errorf("got backlog %T; want *UnifiedBacklog", r.backlog)
+	}
+}
+
+func TestNameEnv(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want []string
+	}{
+		{"", []string{"REFLEX_FILENAME=", "REFLEX_DIR="}},
+		{"a.go", []string{"REFLEX_FILENAME=a.go", "REFLEX_DIR=."}},
+		{"x/y/b.go", []string{"REFLEX_FILENAME=x/y/b.go", "REFLEX_DIR=x/y"}},
+	} {
+		if got := nameEnv(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("nameEnv(%q): got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSubstituteNameParts(t *testing.T) {
+	r := newTestReflex(t, "--", "protoc", "-I", "{dir}", "--descriptor_set_out={base}.pb", "{ext}", "{}")
+	for _, tt := range []struct {
+		name string
+		want []string
+	}{
+		{"proto/v1/user.proto", []string{"protoc", "-I", "proto/v1", "--descriptor_set_out=user.proto.pb", ".proto", "proto/v1/user.proto"}},
+		{"user.proto", []string{"protoc", "-I", ".", "--descriptor_set_out=user.proto.pb", ".proto", "user.proto"}},
+		{"proto/v1/", []string{"protoc", "-I", "proto", "--descriptor_set_out=v1.pb", "", "proto/v1/"}},
+	} {
+		if got := r.substitute(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("substitute(%q): got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+	if _, ok := r.backlog.(*UniqueFilesBacklog); !ok {
+		t.Errorf("got backlog %T; want *UniqueFilesBacklog", r.backlog)
+	}
+
+	// The tokens don't depend on each other's values.
+	r = newTestReflex(t, "--", "echo", "{base}", "{dir}")
+	if got, want := r.substitute("{dir}/{base}"), []string{"echo", "{base}", "{dir}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("substitute: got %q; want %q", got, want)
+	}
+}
+
+func TestSubstituteCommandFormat(t *testing.T) {
+	r := newTestReflex(t, "--command-format", "--then=echo done: %b", "--",
+		"sh", "-c", "go vet ./%d && echo %f %e %n {} 100%%")
+	r.count = 2
+	got := r.substitute("cmd/server/main.go")
+	want := []string{"sh", "-c", "go vet ./cmd/server && echo cmd/server/main.go .go 2 {} 100%"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("substitute: got %q; want %q", got, want)
+	}
+	if got, want := r.expand(r.then[0], "main.go"), []string{"echo", "done:", "main.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expand(--then): got %q; want %q", got, want)
+	}
+	if _, ok := r.backlog.(*UniqueFilesBacklog); !ok {
+		t.Errorf("got backlog %T; want *UniqueFilesBacklog", r.backlog)
+	}
+
+	// %n and %% don't depend on the changed file.
+	r = newTestReflex(t, "--command-format", "--", "echo", "%n files, 100%%")
+	if _, ok := r.backlog.(*UnifiedBacklog); !ok {
+		t.Errorf("got backlog %T; want *UnifiedBacklog", r.backlog)
+	}
+	if !r.countToken {
+		t.Error("got countToken = false for a command with %n")
+	}
+}
+
+func TestNearestDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "reflex-nearest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"services/foo/src", "services/bar"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"Makefile", "services/foo/Makefile"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		file string
+		want string // relative to root; "" for an error
+	}{
+		{"services/foo/src/x.go", "Makefile", "services/foo"},
+		{"services/foo/Makefile", "Makefile", "services/foo"},
+		{"services/foo/", "Makefile", "services/foo"},
+		{"services/bar/y.go", "Makefile", "."},
+		{"main.go", "Makefile", "."},
+		{"", "Makefile", "."},
+		{"services/foo/src/x.go", "go.mod", ""},
+	} {
+		got, err := nearestDir(root, tt.name, tt.file)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("nearestDir(%q, %q): got %q; want an error", tt.name, tt.file, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("nearestDir(%q, %q): %s", tt.name, tt.file, err)
+			continue
+		}
+		if want := filepath.Join(root, tt.want); got != want {
+			t.Errorf("nearestDir(%q, %q): got %q; want %q", tt.name, tt.file, got, want)
+		}
+	}
+
+	// The search stops at the --watch-dir root that the name is in.
+	defer func(dirs map[string]bool) { watchDirs = dirs }(watchDirs)
+	foo, bar := filepath.Join(root, "services/foo"), filepath.Join(root, "services/bar")
+	watchDirs = map[string]bool{foo: true, bar: true}
+	if got, err := nearestDir(root, rootedName(foo, "src/x.go"), "Makefile"); err != nil || got != foo {
+		t.Errorf("nearestDir in --watch-dir %s: got %q, %v; want %q", foo, got, err, foo)
+	}
+	if got, err := nearestDir(root, rootedName(bar, "y.go"), "Makefile"); err == nil {
+		t.Errorf("nearestDir in --watch-dir %s: got %q; want an error (the Makefile above it is outside)", bar, got)
+	}
+}
+
+func TestServiceCommandNotSubstituted(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want []string
+	}{
+		// The substitution symbol split across arguments.
+		{`-s -- echo '{' '}'`, []string{"echo", "{", "}"}},
+		// With a different substitution symbol, {} is literal.
+		{`-s --substitute=@@ -- echo {}`, []string{"echo", "{}"}},
+		// {N} is not a token without regex capture groups.
+		{`-s -r '\.go$' -- echo {1}`, []string{"echo", "{1}"}},
+		// An escaped symbol is passed through literally.
+		{`-s -- find . -exec echo {{}} ;`, []string{"find", ".", "-exec", "echo", "{}", ";"}},
+	} {
+		configs, err := readConfigsFromReader(strings.NewReader(tt.line), "test input")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReflex(configs[0])
+		if err != nil {
+			t.Errorf("NewReflex for %q: %s", tt.line, err)
+			continue
+		}
+		if got := r.commandFor(""); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("commandFor for %q: got %q; want %q", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{
+		// Quoting joins the pieces into a single {} token.
+		`-s -- echo "{"'}'`,
+		`-s -- sh -c 'echo {}'`,
+		`-s -r '(\w+)\.go$' -- echo {1}`,
+		`-s --substitute=@@ -- echo @@`,
+		`-s -- echo {match:1}`,
+	} {
+		configs, err := readConfigsFromReader(strings.NewReader(line), "test input")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewReflex(configs[0]); err == nil {
+			t.Errorf("NewReflex for %q: got nil error for a service with a substitution token", line)
+		}
+	}
+}
+
+func TestBacklogSelection(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want Backlog
+	}{
+		{[]string{"echo", "hi"}, &UnifiedBacklog{}},
+		{[]string{"echo", "{}"}, &UniqueFilesBacklog{}},
+		{[]string{"echo", "{{}}"}, &UnifiedBacklog{}},
+		{[]string{"echo", "{{}}", "{}"}, &UniqueFilesBacklog{}},
+		{[]string{"--substitute-first", "echo", "{}"}, &UnifiedBacklog{}},
+		{[]string{"--substitute-first", "echo", "hi"}, &UnifiedBacklog{}},
+		{[]string{"--stdin-file", "cat"}, &UniqueFilesBacklog{}},
+		{[]string{"--stdin-file", "--substitute-first", "cat"}, &UnifiedBacklog{}},
+		{[]string{"--stdin-file", "-s", "cat"}, &UnifiedBacklog{}},
+	} {
+		r := newTestReflex(t, tt.args...)
+		if got, want := reflect.TypeOf(r.backlog), reflect.TypeOf(tt.want); got != want {
+			t.Errorf("backlog for %q: got %s; want %s", tt.args, got, want)
+		}
+	}
+}
+
+func TestFilterMatchingOnlyExecutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, mode := range map[string]os.FileMode{
+		"script.sh": 0755,
+		"data.txt":  0644,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestReflex(t, "--only-executable", "--", "true")
+	in := make(chan string)
+	out := make(chan string, 10)
+	go func() {
+		for _, name := range []string{"script.sh", "data.txt", "subdir", "deleted.sh"} {
+			in <- filepath.Join(dir, name)
+		}
+		close(in)
+	}()
+	r.filterMatching(out, in)
+	close(out)
+	var got []string
+	for name := range out {
+		got = append(got, filepath.Base(name))
+	}
+	if want := []string{"script.sh"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filterMatching with --only-executable: got %q; want %q", got, want)
+	}
+}
+
+func TestFilterMatchingDryRun(t *testing.T) {
+	defer func(dryRun bool, ch chan OutMsg) {
+		flagDryRun = dryRun
+		stdout = ch
+	}(flagDryRun, stdout)
+	flagDryRun = true
+	stdout = make(chan OutMsg, 10)
+
+	r := newTestReflex(t, "-r", `\.go$`, "--", "true")
+	in := make(chan string, 2)
+	in <- "main.go"
+	in <- "README.md"
+	close(in)
+	out := make(chan string, 2)
+	r.filterMatching(out, in)
+	if len(out) > 0 {
+		t.Errorf("filterMatching with --dry-run passed on %q", <-out)
+	}
+	close(stdout)
+	var got []string
+	for msg := range stdout {
+		got = append(got, msg.msg)
+	}
+	want := []string{
+		`main.go: matched; would run ["true"]`,
+		`README.md: no match (rejected by Regex match: "\\.go$")`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("filterMatching with --dry-run: got messages %q; want %q", got, want)
+	}
+}
+
+func TestFilterMatchingTrigger(t *testing.T) {
+	r := newTestReflex(t, "-r", `\.go$`, "--only-files", "--", "true")
+	in := make(chan string, 2)
+	in <- ""
+	in <- "README.md"
+	close(in)
+	out := make(chan string, 2)
+	r.filterMatching(out, in)
+	close(out)
+	var got []string
+	for name := range out {
+		got = append(got, name)
+	}
+	if want := []string{""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filterMatching with a manual trigger: got %q; want %q", got, want)
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	for _, tt := range []struct {
+		lines   string
+		wantErr bool
+	}{
+		{"echo a\necho b", false},
+		{"-n web echo a\n--name=db echo b\necho c", false},
+		{"-n web echo a\necho b\n--name=web echo c", true},
+	} {
+		configs, err := readConfigsFromReader(strings.NewReader(tt.lines), "test input")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reflexes []*Reflex
+		for _, config := range configs {
+			r, err := NewReflex(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reflexes = append(reflexes, r)
+		}
+		if err := checkNames(reflexes); (err != nil) != tt.wantErr {
+			t.Errorf("checkNames for %q: got error %v; want error: %t", tt.lines, err, tt.wantErr)
+		}
+	}
+}
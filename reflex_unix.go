@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/creack/pty"
+)
+
+// havePty reports whether commands can be run with a pty (see --no-pty).
+const havePty = true
+
+// startWithPty starts cmd with a new pty for any of stdin, stdout, and stderr
+// that aren't already set, and returns the pty.
+func startWithPty(cmd *exec.Cmd) (*os.File, error) {
+	// Make the first of the streams on the pty the controlling terminal
+	// (so that terminate's ^C works). If there isn't one, the child has no
+	// controlling terminal.
+	attrs := &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	switch {
+	case cmd.Stdin == nil:
+		attrs.Ctty = 0
+	case cmd.Stdout == nil:
+		attrs.Ctty = 1
+	case cmd.Stderr == nil:
+		attrs.Ctty = 2
+	default:
+		attrs.Setctty = false
+	}
+	return pty.StartWithAttrs(cmd, nil, attrs)
+}
+
+// setSession makes cmd start in a session (and so a process group) of its own,
+// so that kill can signal it along with any children it starts. (Setpgid isn't
+// needed, and would fail: a session leader can't change its process group.)
+func setSession(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// resizePty keeps the size of tty the same as that of reflex's own terminal
+// until the returned function is called.
+func resizePty(tty *os.File) (stop func()) {
+	chResize := make(chan os.Signal, 1)
+	signal.Notify(chResize, syscall.SIGWINCH)
+	go func() {
+		for range chResize {
+			// Intentionally ignore errors in case stdout is not a tty
+			pty.InheritSize(os.Stdout, tty)
+		}
+	}()
+	chResize <- syscall.SIGWINCH // Initial resize.
+	return func() {
+		signal.Stop(chResize)
+		close(chResize)
+	}
+}
+
+// kill sends sig to cmd's process group or, with --no-process-group-kill, to
+// the process alone.
+func (r *Reflex) kill(cmd *exec.Cmd, sig syscall.Signal) error {
+	if r.noGroupKill {
+		return syscall.Kill(cmd.Process.Pid, sig)
+	}
+	// Instead of killing the process, we want to kill its whole pgroup in
+	// order to clean up any children the process may have created. Every
+	// command is started in a new session, with or without a pty (see
+	// startWithPty and setSession), so the group's id is the command's pid.
+	return syscall.Kill(-1*cmd.Process.Pid, sig)
+}
@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTerminateKillsGrandchildren(t *testing.T) {
+	for _, args := range [][]string{
+		{"-s"},
+		{"-s", "--no-pty"},
+	} {
+		// The shell starts a grandchild (which ignores the ^C or
+		// SIGINT, so it only dies from SIGKILL) and waits for it.
+		script := `trap '' INT; sleep 30 & echo $!; wait`
+		r := newTestReflex(t, append(args, "--shutdown-timeout=100ms", "--", "sh", "-c", script)...)
+		out := make(chan OutMsg, 10)
+		done, err := r.runCommand("", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var grandchild int
+		select {
+		case msg := <-out:
+			if grandchild, err = strconv.Atoi(msg.msg); err != nil {
+				t.Fatalf("%q: got output %q; want a pid", args, msg.msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: no output", args)
+		}
+		r.terminate()
+		<-done
+		deadline := time.Now().Add(5 * time.Second)
+		for !processGone(grandchild) {
+			if time.Now().After(deadline) {
+				syscall.Kill(grandchild, syscall.SIGKILL)
+				t.Fatalf("%q: grandchild %d is still running after terminate", args, grandchild)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// processGone reports whether the process pid has exited. (A zombie, which
+// nobody may reap in a container, counts as exited.)
+func processGone(pid int) bool {
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return true
+	}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, which is in parentheses.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
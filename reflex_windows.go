@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// havePty reports whether commands can be run with a pty (see --no-pty).
+// Windows has none, so commands always run as with --no-pty.
+const havePty = false
+
+func startWithPty(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("ptys are not supported on Windows")
+}
+
+// setSession makes cmd start in a process group of its own, so that kill can
+// send it a Ctrl-Break.
+func setSession(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+func resizePty(tty *os.File) (stop func()) {
+	return func() {}
+}
+
+var generateConsoleCtrlEvent = syscall.NewLazyDLL("kernel32.dll").NewProc("GenerateConsoleCtrlEvent")
+
+// ctrlBreakEvent is the CTRL_BREAK_EVENT for GenerateConsoleCtrlEvent.
+const ctrlBreakEvent = 1
+
+// kill stops cmd. Windows doesn't have signals, so for SIGKILL, kill ends the
+// process (and, unless --no-process-group-kill is set, its children) with
+// taskkill /F; for any other signal, it sends a Ctrl-Break to the process's
+// group, which console programs treat like a ^C.
+func (r *Reflex) kill(cmd *exec.Cmd, sig syscall.Signal) error {
+	pid := cmd.Process.Pid
+	if sig != syscall.SIGKILL {
+		ok, _, err := generateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(pid))
+		if ok == 0 {
+			return err
+		}
+		return nil
+	}
+	args := []string{"/F", "/PID", strconv.Itoa(pid)}
+	if !r.noGroupKill {
+		args = append(args, "/T")
+	}
+	return exec.Command("taskkill", args...).Run()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// configPollInterval is how often pollConfig checks the config file.
+var configPollInterval = time.Second
+
+// pollConfig watches the config file at path and reloads it (see
+// reloadConfig) whenever its contents change. It never returns.
+func pollConfig(path string) {
+	last, _ := ioutil.ReadFile(path)
+	for range time.Tick(configPollInterval) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil || bytes.Equal(b, last) {
+			// The file may be in the middle of being replaced;
+			// check again next time.
+			continue
+		}
+		last = b
+		reloadConfig(path)
+	}
+}
+
+// reloadConfig reads the config file at path again and replaces the running
+// reflexes with ones made from it. If the file can't be used, the old reflexes
+// are left running.
+func reloadConfig(path string) {
+	// Global flags are only set when reflex starts, so the !global lines
+	// are ignored.
+	configs, _, err := ReadConfigs(path)
+	if err == nil && len(configs) == 0 {
+		err = errors.New("no configurations found")
+	}
+	var rs []*Reflex
+	for _, config := range configs {
+		if err != nil {
+			break
+		}
+		var r *Reflex
+		if r, err = NewReflex(config); err == nil {
+			rs = append(rs, r)
+		}
+	}
+	if err == nil {
+		err = checkNames(rs)
+	}
+	if err != nil {
+		infoPrintf(-1, "Not reloading %s: %s", path, err)
+		return
+	}
+
+	changes := make([]chan string, len(rs))
+	for i := range changes {
+		changes[i] = make(chan string)
+	}
+	reflexesMu.Lock()
+	old, oldChanges := reflexes, reflexChanges
+	reflexes, reflexChanges = rs, changes
+	reflexesMu.Unlock()
+
+	infoPrintf(-1, "%s changed; restarting with %d commands", path, len(rs))
+	var wg sync.WaitGroup
+	for _, r := range old {
+		wg.Add(1)
+		go func(r *Reflex) {
+			r.retire()
+			wg.Done()
+		}(r)
+	}
+	wg.Wait()
+	for i, r := range rs {
+		r.Start(changes[i])
+	}
+	// Nothing is sent to the old channels now (broadcast checks whether
+	// each reflex is retired), so close them to let the old reflexes'
+	// goroutines finish.
+	broadcastMu.Lock()
+	for _, c := range oldChanges {
+		close(c)
+	}
+	broadcastMu.Unlock()
+	// The new commands may match files in directories that the old ones
+	// excluded, so the watches are brought up to date.
+	rewatchRoots()
+}
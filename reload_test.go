@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reflex.conf")
+
+	defer func(rs []*Reflex, changes []chan string) {
+		reflexes, reflexChanges = rs, changes
+	}(reflexes, reflexChanges)
+	old := newTestReflex(t, "--", "true")
+	reflexes = []*Reflex{old}
+
+	// A bad config file leaves the old reflexes alone.
+	if err := ioutil.WriteFile(path, []byte("-r '[' -- echo bad\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(path)
+	if rs := currentReflexes(); len(rs) != 1 || rs[0] != old {
+		t.Fatalf("after reloading a bad config: got reflexes %v; want the old one", rs)
+	}
+	if old.isRetired() {
+		t.Fatal("after reloading a bad config: the old reflex was retired")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("-- echo one\n-r x -- echo two\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(path)
+	rs := currentReflexes()
+	if _, changes := currentChanges(); len(rs) != 2 || len(changes) != 2 {
+		t.Fatalf("after reloading: got %d reflexes and %d channels; want 2 of each", len(rs), len(changes))
+	}
+	for i, want := range []string{"one", "two"} {
+		if got := rs[i].command[1]; got != want {
+			t.Errorf("reflex %d: got command %q; want echo %s", i, rs[i].command, want)
+		}
+	}
+	if !old.isRetired() {
+		t.Error("after reloading: the old reflex was not retired")
+	}
+}
+
+func TestRetire(t *testing.T) {
+	r := newTestReflex(t, "--debounce=10ms", "--shutdown-timeout=100ms", "--", "sleep", "10")
+	changes := make(chan string)
+	r.Start(changes)
+	changes <- "a.go"
+	deadline := time.Now().Add(5 * time.Second)
+	for !r.Running() {
+		if time.Now().After(deadline) {
+			t.Fatal("the command did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	retired := make(chan struct{})
+	go func() {
+		r.retire()
+		close(retired)
+	}()
+	select {
+	case <-retired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retire did not return")
+	}
+	if r.Running() {
+		t.Error("the command is still running after retire")
+	}
+	if _, err := r.runCommand("a.go", stdout); err != errRetired {
+		t.Errorf("runCommand after retire: got error %v; want errRetired", err)
+	}
+}
+
+func TestRetireWaitingForCount(t *testing.T) {
+	r := newTestReflex(t, "--", "echo", "{count}")
+	names := make(chan string)
+	r.stopped = make(chan struct{})
+	go func() {
+		r.runEach(names)
+		close(r.stopped)
+	}()
+	// runEach now waits for the count that batch would send next.
+	names <- "a.go"
+
+	retired := make(chan struct{})
+	go func() {
+		r.retire()
+		close(retired)
+	}()
+	select {
+	case <-retired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retire did not return while runEach waited for the count")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build freebsd || dragonfly
+// +build freebsd dragonfly
+
+package main
+
+// rlimitValue converts n to the type of the fields of syscall.Rlimit, which is
+// int64 on FreeBSD and DragonFly.
+func rlimitValue(n uint64) int64 { return int64(n) }
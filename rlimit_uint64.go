@@ -0,0 +1,8 @@
+//go:build !windows && !freebsd && !dragonfly
+// +build !windows,!freebsd,!dragonfly
+
+package main
+
+// rlimitValue converts n to the type of the fields of syscall.Rlimit, which is
+// uint64 on most systems (see rlimit_int64.go for the others).
+func rlimitValue(n uint64) uint64 { return n }
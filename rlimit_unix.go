@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// darwinMaxFiles is the largest soft open file limit macOS allows processes
+// to set (OPEN_MAX), even when the hard limit is reported as unlimited.
+const darwinMaxFiles = 10240
+
+// raiseOpenFileLimit raises the soft limit on open files as far as possible
+// and reports whether it changed.
+func raiseOpenFileLimit() bool {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return false
+	}
+	for _, n := range []uint64{uint64(lim.Max), darwinMaxFiles} {
+		if n <= uint64(lim.Cur) {
+			continue
+		}
+		raised := lim
+		raised.Cur = rlimitValue(n)
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err == nil {
+			return true
+		}
+	}
+	return false
+}
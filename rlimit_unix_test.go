@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestRaiseOpenFileLimit(t *testing.T) {
+	var orig syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &orig); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &orig)
+
+	lowered := orig
+	lowered.Cur = 64
+	if lowered.Cur >= lowered.Max {
+		t.Skipf("hard open file limit is too low (%d)", orig.Max)
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Fatal(err)
+	}
+	if !raiseOpenFileLimit() {
+		t.Fatal("raiseOpenFileLimit: got false")
+	}
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	if lim.Cur <= lowered.Cur {
+		t.Errorf("after raiseOpenFileLimit, soft limit is %d; want > %d", lim.Cur, lowered.Cur)
+	}
+	if raiseOpenFileLimit() && lim.Cur == lim.Max {
+		t.Error("raiseOpenFileLimit: got true when already at the hard limit")
+	}
+}
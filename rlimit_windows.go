@@ -0,0 +1,7 @@
+package main
+
+// raiseOpenFileLimit reports whether it raised the limit on open files, which
+// Windows doesn't have.
+func raiseOpenFileLimit() bool {
+	return false
+}
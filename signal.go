@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalsByName are the signals that can be given by name, as for
+// --restart-signal. Those that only exist on Unix are added in signal_unix.go.
+var signalsByName = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGALRM": syscall.SIGALRM,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// triggerSignals are the signals that make every command run (or every
+// service restart) as though a file had changed. SIGUSR1 is added in
+// signal_unix.go; Windows has no such signal.
+var triggerSignals []os.Signal
+
+// pauseSignals are the signals that pause reflex or, when it is paused,
+// resume it. SIGUSR2 is added in signal_unix.go.
+var pauseSignals []os.Signal
+
+// parseSignal parses a signal given by name, with or without the SIG prefix
+// and in any case (SIGHUP, hup), or by number.
+func parseSignal(s string) (syscall.Signal, error) {
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signalsByName[name]; ok {
+		return sig, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// signalName returns the name of sig, such as SIGHUP.
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalsByName {
+		if s == sig {
+			return name
+		}
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
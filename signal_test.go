@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want syscall.Signal
+	}{
+		{"SIGHUP", syscall.SIGHUP},
+		{"hup", syscall.SIGHUP},
+		{"SigUsr1", syscall.SIGUSR1},
+		{"TERM", syscall.SIGTERM},
+		{"1", syscall.Signal(1)},
+	} {
+		got, err := parseSignal(tt.s)
+		if err != nil {
+			t.Errorf("parseSignal(%q): %s", tt.s, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSignal(%q): got %d; want %d", tt.s, got, tt.want)
+		}
+	}
+	for _, s := range []string{"", "SIGNOPE", "0", "-1"} {
+		if _, err := parseSignal(s); err == nil {
+			t.Errorf("parseSignal(%q): got nil error", s)
+		}
+	}
+	if got := signalName(syscall.SIGHUP); got != "SIGHUP" {
+		t.Errorf("signalName(SIGHUP): got %q", got)
+	}
+}
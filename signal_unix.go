@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func init() {
+	for name, sig := range map[string]syscall.Signal{
+		"SIGUSR1":  syscall.SIGUSR1,
+		"SIGUSR2":  syscall.SIGUSR2,
+		"SIGCONT":  syscall.SIGCONT,
+		"SIGWINCH": syscall.SIGWINCH,
+	} {
+		signalsByName[name] = sig
+	}
+	triggerSignals = []os.Signal{syscall.SIGUSR1}
+	pauseSignals = []os.Signal{syscall.SIGUSR2}
+}
@@ -1,42 +1,212 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
 const chmodMask fsnotify.Op = ^fsnotify.Op(0) ^ fsnotify.Chmod
 
+var errTooManyWatches = errors.New("too many directories to watch")
+
+// Each watch root (see --watch-dir) has its own watcher and watch goroutine,
+// so the bookkeeping shared between them is protected by watchesMu.
+var (
+	watchesMu sync.Mutex
+	// watchCounts is the number of directories each watcher watches.
+	watchCounts = make(map[*fsnotify.Watcher]int)
+	// With --follow-symlinks, watchedDirs holds the real paths (with
+	// symlinks resolved) of the directories each watcher watches, so that
+	// a directory reached through more than one link (or through a link
+	// to one of its ancestors) is only watched once.
+	watchedDirs = make(map[*fsnotify.Watcher]map[string]bool)
+	// These record how we've handled running out of file descriptors
+	// while adding watches (as happens with kqueue, which needs one for
+	// each directory).
+	raisedFileLimit bool
+	warnedFileLimit bool
+	// warnedWatchLimit records whether we've said that the system's limit
+	// on watches (fs.inotify.max_user_watches on Linux) was reached.
+	warnedWatchLimit bool
+)
+
+// totalWatches returns the number of directories watched by all the watchers.
+// watchesMu must be held.
+func totalWatches() int {
+	n := 0
+	for _, count := range watchCounts {
+		n += count
+	}
+	return n
+}
+
+// rewatch is closed (and replaced) by rewatchRoots to have each watch goroutine
+// walk its root again. It is protected by watchesMu.
+var rewatch = make(chan struct{})
+
+// rewatchRoots has every watch goroutine walk its root again, adding watches
+// for the directories that the reflexes no longer exclude (as after the config
+// file is reloaded).
+func rewatchRoots() {
+	watchesMu.Lock()
+	defer watchesMu.Unlock()
+	close(rewatch)
+	rewatch = make(chan struct{})
+}
+
+// rewatchChan returns the channel that the next call to rewatchRoots closes.
+func rewatchChan() <-chan struct{} {
+	watchesMu.Lock()
+	defer watchesMu.Unlock()
+	return rewatch
+}
+
+// watchDirs holds the extra roots given with --watch-dir (as given). The names
+// of the files in them are reported with the root in front (see rootedName).
+// It is set before any watching starts.
+var watchDirs = make(map[string]bool)
+
+// With --watchdog, superviseWatch periodically creates a file called
+// watchdogSentinel in each watch root, and watch sends on the root's
+// watchdogSeen channel when it sees the file (instead of reporting it).
+var (
+	watchdogSentinel string
+
+	watchdogMu   sync.Mutex
+	watchdogSeen = make(map[string]chan struct{}) // by root
+)
+
+// watchdogChan returns the channel that watch sends on when it sees the
+// sentinel in root.
+func watchdogChan(root string) chan struct{} {
+	watchdogMu.Lock()
+	defer watchdogMu.Unlock()
+	seen, ok := watchdogSeen[root]
+	if !ok {
+		seen = make(chan struct{}, 1)
+		watchdogSeen[root] = seen
+	}
+	return seen
+}
+
 // watch recursively watches changes in root and reports the filenames to names.
 // It sends an error on the done chan.
 // As an optimization, any dirs we encounter that meet the ExcludePrefix
-// criteria of all reflexes can be ignored.
-func watch(root string, watcher *fsnotify.Watcher, names chan<- string, done chan<- error, reflexes []*Reflex) {
-	if err := filepath.Walk(root, walker(watcher, reflexes)); err != nil {
-		infoPrintf(-1, "Error while walking path %s: %s", root, err)
+// criteria of all reflexes can be ignored. The reflexes are those returned by
+// reflexes when each directory is walked, so that the directories watched
+// follow the config file as it is reloaded.
+//
+// If root doesn't exist yet, watch waits for it to be created (by watching its
+// closest existing ancestor) and then watches it as usual.
+func watch(root string, watcher *fsnotify.Watcher, names chan<- string, done chan<- error, reflexes func() []*Reflex) {
+	rewalk := rewatchChan()
+	var ancestors []string // watched while waiting for root to be created
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		ancestor, created, err := watchAncestor(root, watcher)
+		if err != nil {
+			done <- err
+			return
+		}
+		ancestors = append(ancestors, ancestor)
+		if created {
+			ancestors = rootCreated(root, watcher, ancestors)
+		} else {
+			infoPrintf(-1, "%s does not exist; waiting for it to be created", root)
+		}
+	}
+	if len(ancestors) == 0 {
+		if err := addWatches(root, root, watcher, reflexes); err != nil {
+			done <- err
+			return
+		}
 	}
 
 	for {
 		select {
-		case e := <-watcher.Events:
+		case <-rewalk:
+			rewalk = rewatchChan()
+			if len(ancestors) == 0 {
+				if err := addWatches(root, root, watcher, reflexes); err != nil {
+					done <- err
+					return
+				}
+			}
+		case e, ok := <-watcher.Events:
+			if !ok {
+				// The watcher was closed.
+				return
+			}
 			if verbose {
 				infoPrintln(-1, "fsnotify event:", e)
 			}
+			if watchdogSentinel != "" && filepath.Clean(e.Name) == filepath.Join(root, watchdogSentinel) {
+				if e.Op&fsnotify.Create != 0 {
+					select {
+					case watchdogChan(root) <- struct{}{}:
+					default:
+					}
+				}
+				continue
+			}
+			if len(ancestors) > 0 {
+				if e.Op&fsnotify.Create == 0 {
+					continue
+				}
+				// Something was created on the way to root; watch
+				// the new closest ancestor or, if root is there
+				// now, root itself.
+				ancestor, created, err := watchAncestor(root, watcher)
+				if err != nil {
+					done <- err
+					return
+				}
+				ancestors = append(ancestors, ancestor)
+				if !created {
+					continue
+				}
+				ancestors = rootCreated(root, watcher, ancestors)
+				if err := addWatches(root, root, watcher, reflexes); err != nil {
+					done <- err
+					return
+				}
+				continue
+			}
 			stat, err := os.Stat(e.Name)
 			if err != nil {
 				continue
 			}
-			path := normalize(e.Name, stat.IsDir())
-			if e.Op&chmodMask == 0 {
+			path := normalize(root, e.Name, stat.IsDir())
+			if strings.HasPrefix(path, "../") {
+				// A late event from an ancestor of root.
 				continue
 			}
-			names <- path
+			if flagCanonicalCase {
+				path = canonicalCase(root, path)
+			}
+			if e.Op&chmodMask == 0 || path == "" {
+				// Ignore chmod events and events for root itself.
+				continue
+			}
+			if reportEvent(stat.IsDir()) {
+				atomic.AddInt64(&eventsReceived, 1)
+				names <- rootedName(root, path)
+			}
 			if e.Op&fsnotify.Create > 0 && stat.IsDir() {
-				if err := filepath.Walk(path, walker(watcher, reflexes)); err != nil {
-					infoPrintf(-1, "Error while walking path %s: %s", path, err)
+				if err := addWatches(root, e.Name, watcher, reflexes); err != nil {
+					done <- err
+					return
 				}
 			}
 			// TODO: Cannot currently remove fsnotify watches
@@ -44,22 +214,164 @@ func watch(root string, watcher *fsnotify.Watcher, names chan<- string, done cha
 			// https://github.com/cespare/reflex/issues/13
 			// https://github.com/go-fsnotify/fsnotify/issues/40
 			// https://github.com/go-fsnotify/fsnotify/issues/41
-		case err := <-watcher.Errors:
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			done <- err
+			return
+		}
+	}
+}
+
+// superviseWatch runs watch on root (with a new watcher) for --watchdog;
+// watchdogSentinel must be set. Every
+// so often it checks that the watcher still delivers events; if not, it closes
+// the watcher and starts over with a new one, re-adding all the watches.
+func superviseWatch(root string, names chan<- string, done chan<- error, reflexes func() []*Reflex) {
+	for {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
 			done <- err
 			return
 		}
+		stopped := make(chan struct{})
+		go func() {
+			watch(root, watcher, names, done, reflexes)
+			close(stopped)
+		}()
+		for {
+			time.Sleep(flagWatchdog)
+			if !checkWatcher(root) {
+				break
+			}
+		}
+		if verbose {
+			infoPrintf(-1, "The watcher for %s stopped delivering events; rebuilding it", root)
+		}
+		watcher.Close()
+		<-stopped
+		watchesMu.Lock()
+		delete(watchCounts, watcher)
+		delete(watchedDirs, watcher)
+		watchesMu.Unlock()
+	}
+}
+
+// checkWatcher creates the watchdogSentinel file in root and reports whether
+// watch sees it within the --watchdog interval. If the file can't be created
+// (say, because root doesn't exist yet), the watcher is assumed to be fine.
+func checkWatcher(root string) bool {
+	seen := watchdogChan(root)
+	// Drop any sighting left over from the last check.
+	select {
+	case <-seen:
+	default:
+	}
+	sentinel := filepath.Join(root, watchdogSentinel)
+	if err := ioutil.WriteFile(sentinel, nil, 0644); err != nil {
+		return true
+	}
+	defer os.Remove(sentinel)
+	select {
+	case <-seen:
+		return true
+	case <-time.After(flagWatchdog):
+		return false
+	}
+}
+
+// watchAncestor adds a watch for the closest existing ancestor of root, which
+// doesn't exist (or didn't when watch last checked), so that watch can tell
+// when root is created. It returns the ancestor and whether root exists now.
+func watchAncestor(root string, watcher *fsnotify.Watcher) (ancestor string, created bool, err error) {
+	ancestor = filepath.Dir(filepath.Clean(root))
+	for {
+		if _, err := os.Stat(ancestor); err == nil {
+			break
+		}
+		parent := filepath.Dir(ancestor)
+		if parent == ancestor {
+			break
+		}
+		ancestor = parent
+	}
+	if err := watcher.Add(ancestor); err != nil {
+		return "", false, err
+	}
+	_, err = os.Stat(root)
+	return ancestor, err == nil, nil
+}
+
+// rootCreated removes the watches on the ancestors of root once it has been
+// created. It returns the new (empty) list of ancestors.
+func rootCreated(root string, watcher *fsnotify.Watcher, ancestors []string) []string {
+	for _, ancestor := range ancestors {
+		watcher.Remove(ancestor)
 	}
+	infoPrintf(-1, "%s was created; watching it", root)
+	return nil
 }
 
-func walker(watcher *fsnotify.Watcher, reflexes []*Reflex) filepath.WalkFunc {
+// reportEvent reports whether an event for a file or (if dir is set) a
+// directory should be passed on to the reflexes. With --dir-events=false,
+// directory events are dropped; new directories are still watched.
+func reportEvent(dir bool) bool {
+	return flagDirEvents || !dir
+}
+
+// addWatches recursively adds watches for path (a directory within the watch
+// root) and its subdirectories. Errors while walking are printed; an error is
+// returned only if the walk was stopped because the --max-watches limit was
+// reached, or if root itself turns out not to be a directory.
+//
+// Only the walk of the whole root is held to --max-watches: the count isn't
+// lowered when directories are removed, so limiting the directories created
+// later would eventually stop a long-running reflex in a tree where build
+// directories come and go.
+//
+// Walking the whole root again (see rewatchRoots) adds the directories that
+// weren't watched before; the directories already watched are watched anew
+// (which does nothing) and counted again.
+func addWatches(root, path string, watcher *fsnotify.Watcher, reflexes func() []*Reflex) error {
+	if path == root {
+		if stat, err := os.Stat(root); err == nil && !stat.IsDir() {
+			return fmt.Errorf("Cannot watch %s: it is not a directory.", root)
+		}
+		watchesMu.Lock()
+		delete(watchCounts, watcher)
+		delete(watchedDirs, watcher)
+		watchesMu.Unlock()
+	}
+	err := filepath.Walk(path, walker(root, watcher, reflexes, path == root))
+	if err == errTooManyWatches {
+		return fmt.Errorf("Cannot watch more than %d directories (see --max-watches). "+
+			"Try running reflex in a more specific directory or excluding large "+
+			"subdirectories (for example, with -R '^node_modules/').", flagMaxWatches)
+	}
+	if err != nil {
+		infoPrintf(-1, "Error while walking path %s: %s", path, err)
+	}
+	return nil
+}
+
+// walker returns the function used by addWatches to walk a directory. If
+// limited is set, the walk stops once --max-watches directories are watched.
+func walker(root string, watcher *fsnotify.Watcher, reflexes func() []*Reflex, limited bool) filepath.WalkFunc {
 	return func(path string, f os.FileInfo, err error) error {
+		if err == nil && flagFollowSymlinks && f.Mode()&os.ModeSymlink != 0 {
+			return followSymlink(root, path, watcher, reflexes, limited)
+		}
 		if err != nil || !f.IsDir() {
 			return nil
 		}
-		path = normalize(path, f.IsDir())
+		name := rootedName(root, normalize(root, path, f.IsDir()))
+		if excludedDir(name) != "" {
+			return filepath.SkipDir
+		}
 		ignore := true
-		for _, r := range reflexes {
-			if !r.matcher.ExcludePrefix(path) {
+		for _, r := range reflexes() {
+			if !r.matcher.ExcludePrefix(name) {
 				ignore = false
 				break
 			}
@@ -67,17 +379,236 @@ func walker(watcher *fsnotify.Watcher, reflexes []*Reflex) filepath.WalkFunc {
 		if ignore {
 			return filepath.SkipDir
 		}
-		if err := watcher.Add(path); err != nil {
+		watchesMu.Lock()
+		defer watchesMu.Unlock()
+		if limited && flagMaxWatches > 0 && totalWatches() >= flagMaxWatches {
+			return errTooManyWatches
+		}
+		var real string
+		if flagFollowSymlinks {
+			if real, err = filepath.EvalSymlinks(path); err != nil {
+				return nil
+			}
+			if watchedDirs[watcher][real] {
+				return filepath.SkipDir
+			}
+		}
+		err = watcher.Add(path)
+		if errors.Is(err, syscall.EMFILE) && !raisedFileLimit {
+			raisedFileLimit = true
+			if raiseOpenFileLimit() {
+				err = watcher.Add(path)
+			}
+		}
+		if errors.Is(err, syscall.EMFILE) {
+			if !warnedFileLimit {
+				warnedFileLimit = true
+				infoPrintf(-1, "Ran out of file descriptors while watching %s, "+
+					"so some directories are not watched. Raise the limit with "+
+					"'ulimit -n', or run reflex in a more specific directory "+
+					"or exclude large subdirectories.", path)
+			}
+			return nil
+		}
+		if errors.Is(err, syscall.ENOSPC) {
+			// Every other directory will fail the same way, so
+			// say so once and don't bother with the rest of this
+			// one.
+			if !warnedWatchLimit {
+				warnedWatchLimit = true
+				infoPrintf(-1, "Reached the system limit on file watches while watching %s, "+
+					"so it and some other directories are not watched. On Linux, raise "+
+					"the limit with 'sudo sysctl fs.inotify.max_user_watches=524288' "+
+					"(add it to /etc/sysctl.conf to keep it), or run reflex in a more "+
+					"specific directory or exclude large subdirectories (see --exclude-dir).", path)
+			}
+			return filepath.SkipDir
+		}
+		if err != nil {
 			infoPrintf(-1, "Error while watching new path %s: %s", path, err)
+			return nil
+		}
+		watchCounts[watcher]++
+		if real != "" {
+			if watchedDirs[watcher] == nil {
+				watchedDirs[watcher] = make(map[string]bool)
+			}
+			watchedDirs[watcher][real] = true
 		}
 		return nil
 	}
 }
 
-func normalize(path string, dir bool) string {
-	path = strings.TrimPrefix(path, "./")
-	if dir && !strings.HasSuffix(path, "/") {
-		path = path + "/"
+// followSymlink adds watches, as addWatches does, for the directory that the
+// symlink path points to (if it is one) and its subdirectories, under the
+// names they have through the link.
+func followSymlink(root, path string, watcher *fsnotify.Watcher, reflexes func() []*Reflex, limited bool) error {
+	if stat, err := os.Stat(path); err != nil || !stat.IsDir() {
+		return nil
+	}
+	// filepath.Walk doesn't follow a symlink given as the root of the
+	// walk, but with a trailing separator the link is resolved.
+	err := filepath.Walk(path+string(filepath.Separator), walker(root, watcher, reflexes, limited))
+	if err == errTooManyWatches {
+		return err
+	}
+	return nil
+}
+
+// explainWatches walks root as watch would and writes a line to w for each
+// directory saying whether it would be watched or, if it is skipped, which
+// matchers exclude it.
+func explainWatches(w io.Writer, root string, reflexes []*Reflex) error {
+	return filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil || !f.IsDir() {
+			return nil
+		}
+		name := rootedName(root, normalize(root, path, f.IsDir()))
+		display := name
+		if display == "" {
+			display = rootedName(root, "./")
+		}
+		if pattern := excludedDir(name); pattern != "" {
+			fmt.Fprintf(w, "skip  %s (excluded by --exclude-dir %q)\n", display, pattern)
+			return filepath.SkipDir
+		}
+		var reasons []string
+		for _, r := range reflexes {
+			excluder := excludedBy(r.matcher, name)
+			if excluder == nil {
+				fmt.Fprintf(w, "watch %s\n", display)
+				return nil
+			}
+			reasons = append(reasons, fmt.Sprintf("[%02d] %s", r.id, excluder))
+		}
+		fmt.Fprintf(w, "skip  %s (excluded by %s)\n", display, strings.Join(reasons, "; "))
+		return filepath.SkipDir
+	})
+}
+
+// excludedDir returns the first --exclude-dir pattern that matches name (a
+// directory, as from rootedName), or "" if none does. A pattern with a / is
+// matched against the whole name; any other, against its last element. The
+// watch root itself is never excluded.
+func excludedDir(name string) string {
+	if name == "" {
+		return ""
+	}
+	name = strings.TrimSuffix(name, "/")
+	for _, pattern := range flagExcludeDirs {
+		target := path.Base(name)
+		if strings.Contains(pattern, "/") {
+			target = name
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// canonicalCase returns path (a name within root, as from normalize) with the
+// case of each element corrected to match the name of the file on disk, for
+// --canonicalize-case. An element is only changed if there is no file with
+// exactly that name but there is a single one whose name matches it
+// case-insensitively.
+func canonicalCase(root, path string) string {
+	dir := strings.HasSuffix(path, "/")
+	elems := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	parent := root
+	for i, elem := range elems {
+		names, err := readDirNames(parent)
+		if err != nil {
+			break
+		}
+		match := ""
+		for _, name := range names {
+			if name == elem {
+				match = name
+				break
+			}
+			if strings.EqualFold(name, elem) {
+				if match != "" {
+					// Ambiguous; leave elem as it is.
+					match = elem
+					break
+				}
+				match = name
+			}
+		}
+		if match != "" {
+			elems[i] = match
+		}
+		parent = filepath.Join(parent, elems[i])
+	}
+	path = strings.Join(elems, "/")
+	if dir {
+		path += "/"
+	}
+	return path
+}
+
+// readDirNames returns the names of the entries of the directory dir.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// normalize returns the name by which path (a file or directory within root)
+// is matched against patterns, passed to ExcludePrefix, and substituted into
+// commands. The name is relative to root, uses forward slashes, has no leading
+// ./ and, for a directory, has a trailing /. The name of root itself is "".
+func normalize(root, path string, dir bool) string {
+	if rel, err := filepath.Rel(root, path); err == nil {
+		path = rel
+	}
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." {
+		return ""
+	}
+	if dir {
+		path += "/"
 	}
 	return path
 }
+
+// rootedName returns name (as from normalize) as it is reported for a file in
+// root: for a --watch-dir root, with the root (as given) in front, so that
+// patterns can tell the roots apart; otherwise, unchanged.
+func rootedName(root, name string) string {
+	if !watchDirs[root] || name == "" {
+		return name
+	}
+	rooted := path.Join(filepath.ToSlash(root), name)
+	if strings.HasSuffix(name, "/") {
+		rooted += "/"
+	}
+	return rooted
+}
+
+// splitRoot undoes rootedName: it returns the root that name was reported for
+// and the name within that root. When several --watch-dir roots fit, the
+// longest wins.
+func splitRoot(name string) (root, rel string) {
+	root, rel = ".", name
+	longest := 0
+	for dir := range watchDirs {
+		prefix := path.Clean(filepath.ToSlash(dir))
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if len(prefix) <= longest || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		root, rel = dir, strings.TrimPrefix(name, prefix)
+		if rel == "" {
+			rel = "./"
+		}
+		longest = len(prefix)
+	}
+	return root, rel
+}
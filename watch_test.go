@@ -0,0 +1,718 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestAddWatchesLimit(t *testing.T) {
+	defer func(max int) { flagMaxWatches = max }(flagMaxWatches)
+
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"a/b", "c"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reflexes := []*Reflex{newTestReflex(t, "--", "true")}
+	// Four directories: dir, a, a/b, and c.
+	for _, tt := range []struct {
+		max     int
+		wantErr bool
+	}{
+		{0, false},
+		{4, false},
+		{3, true},
+	} {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flagMaxWatches = tt.max
+		err = addWatches(dir, dir, watcher, reflexesFunc(reflexes))
+		watcher.Close()
+		delete(watchCounts, watcher)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("addWatches with --max-watches=%d: got error %v; want error: %t", tt.max, err, tt.wantErr)
+		}
+	}
+
+	// Directories created after the initial walk are watched whatever the
+	// count, since it doesn't go down when directories are removed.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	flagMaxWatches = 4
+	if err := addWatches(dir, dir, watcher, reflexesFunc(reflexes)); err != nil {
+		t.Fatal(err)
+	}
+	if err := addWatches(dir, filepath.Join(dir, "a"), watcher, reflexesFunc(reflexes)); err != nil {
+		t.Errorf("addWatches for a new directory at the --max-watches limit: %s", err)
+	}
+	delete(watchCounts, watcher)
+}
+
+// reflexesFunc returns a function that returns rs, to pass to watch.
+func reflexesFunc(rs []*Reflex) func() []*Reflex {
+	return func() []*Reflex { return rs }
+}
+
+func TestNormalize(t *testing.T) {
+	for _, tt := range []struct {
+		root string
+		path string
+		dir  bool
+		want string
+	}{
+		{".", ".", true, ""},
+		{".", "./", true, ""},
+		{".", "./foo.go", false, "foo.go"},
+		{".", "foo.go", false, "foo.go"},
+		{".", "./a/b", true, "a/b/"},
+		{".", "a/b/", true, "a/b/"},
+		{".", "a//b/../c.txt", false, "a/c.txt"},
+		{"src", "src/a/b.go", false, "a/b.go"},
+		{"src", "src", true, ""},
+		{"/home/me/proj", "/home/me/proj/x/y", true, "x/y/"},
+		{"/home/me/proj/", "/home/me/proj/x.go", false, "x.go"},
+	} {
+		if got := normalize(tt.root, tt.path, tt.dir); got != tt.want {
+			t.Errorf("normalize(%q, %q, %t): got %q; want %q", tt.root, tt.path, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestExplainWatchesRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{".hidden", "src"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Excluding dot-prefixed names must not exclude the root itself.
+	reflexes := []*Reflex{newTestReflex(t, "-R", `^\.`, "--", "true")}
+	var buf strings.Builder
+	if err := explainWatches(&buf, dir, reflexes); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{
+		"watch ./",
+		`skip  .hidden/ (excluded by [` + fmt.Sprintf("%02d", reflexes[0].id) + `] Inverted regex match: "^\\.")`,
+		"watch src/",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("explainWatches: got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestWatchDirEvents(t *testing.T) {
+	defer func(dirEvents bool) { flagDirEvents = dirEvents }(flagDirEvents)
+
+	for _, tt := range []struct {
+		dirEvents bool
+		want      []string
+	}{
+		{true, []string{"d/", "f.txt"}},
+		{false, []string{"f.txt"}},
+	} {
+		flagDirEvents = tt.dirEvents
+		dir, err := ioutil.TempDir("", "reflex-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(chan string, 100)
+		done := make(chan error, 1)
+		reflexes := []*Reflex{newTestReflex(t, "--", "true")}
+		stopped := make(chan struct{})
+		go func() {
+			watch(dir, watcher, names, done, reflexesFunc(reflexes))
+			close(stopped)
+		}()
+		// Let the initial walk finish.
+		time.Sleep(100 * time.Millisecond)
+
+		if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := ioutil.WriteFile(filepath.Join(dir, "f.txt"), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make(map[string]bool)
+		var got []string
+	collect:
+		for {
+			select {
+			case name := <-names:
+				if !seen[name] {
+					seen[name] = true
+					got = append(got, name)
+				}
+			case <-time.After(300 * time.Millisecond):
+				break collect
+			}
+		}
+		// Stop watch before changing flagDirEvents for the next case.
+		watcher.Close()
+		<-stopped
+		watchesMu.Lock()
+		delete(watchCounts, watcher)
+		watchesMu.Unlock()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("with --dir-events=%t: got %q; want %q", tt.dirEvents, got, tt.want)
+		}
+	}
+}
+
+// TestWatchAtomicRewrites checks that a file which is repeatedly replaced by
+// renaming a temporary file over it (as many tools write their output) is
+// reported for every rewrite, including the last. Since reflex watches
+// directories rather than files, there is no per-file watch to lose when the
+// file is replaced.
+func TestWatchAtomicRewrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	names := make(chan string, 100)
+	done := make(chan error, 1)
+	reflexes := []*Reflex{newTestReflex(t, "--", "true")}
+	go watch(dir, watcher, names, done, reflexesFunc(reflexes))
+	// Let the initial walk finish.
+	time.Sleep(100 * time.Millisecond)
+
+	path := filepath.Join(dir, "bundle.js")
+	for i := 0; i < 20; i++ {
+		tmp := filepath.Join(dir, fmt.Sprintf(".bundle.js.%d.tmp", i))
+		if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("version %d", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	wait:
+		for {
+			select {
+			case name := <-names:
+				if name == "bundle.js" {
+					break wait
+				}
+			case err := <-done:
+				t.Fatal(err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("rewrite %d of bundle.js was not reported", i)
+			}
+		}
+	}
+}
+
+func TestCanonicalCase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"Src/Main.go", "a.txt", "A.TXT", "B.txt", "b.TXT"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// On a case-insensitive filesystem, the names that differ only in
+	// case are the same file.
+	names, err := readDirNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caseSensitiveFS := len(names) == 5
+
+	for _, tt := range []struct {
+		path          string
+		want          string
+		caseSensitive bool // only on a case-sensitive filesystem
+	}{
+		{"src/main.go", "Src/Main.go", false},
+		{"SRC/", "Src/", false},
+		{"Src/Main.go", "Src/Main.go", false},
+		// An exact match wins.
+		{"a.txt", "a.txt", true},
+		{"A.TXT", "A.TXT", true},
+		// Ambiguous names are left alone.
+		{"b.txt", "b.txt", true},
+		// So are names that don't exist.
+		{"src/other.go", "Src/other.go", false},
+		{"missing/main.go", "missing/main.go", false},
+	} {
+		if tt.caseSensitive && !caseSensitiveFS {
+			continue
+		}
+		if got := canonicalCase(dir, tt.path); got != tt.want {
+			t.Errorf("canonicalCase(%q): got %q; want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestWatchRootCreatedLater(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "not-yet", "built")
+	names := make(chan string, 100)
+	done := make(chan error, 1)
+	reflexes := []*Reflex{newTestReflex(t, "--", "true")}
+	stopped := make(chan struct{})
+	go func() {
+		watch(root, watcher, names, done, reflexesFunc(reflexes))
+		close(stopped)
+	}()
+	defer func() {
+		watcher.Close()
+		<-stopped
+		watchesMu.Lock()
+		delete(watchCounts, watcher)
+		watchesMu.Unlock()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Create the parent first, and then root, so that watch has to
+	// follow along.
+	if err := os.Mkdir(filepath.Join(dir, "not-yet"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := ioutil.WriteFile(filepath.Join(root, "f.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case name := <-names:
+			if strings.HasPrefix(name, "../") {
+				t.Errorf("got name %q from outside root", name)
+			}
+			if name == "f.txt" {
+				return
+			}
+		case err := <-done:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("change in root not reported after root was created")
+		}
+	}
+}
+
+func TestWatchRootCreatedAsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	names := make(chan string, 100)
+	done := make(chan error, 1)
+	reflexes := []*Reflex{newTestReflex(t, "--", "true")}
+	stopped := make(chan struct{})
+	go func() {
+		watch(root, watcher, names, done, reflexesFunc(reflexes))
+		close(stopped)
+	}()
+	defer func() {
+		watcher.Close()
+		<-stopped
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := ioutil.WriteFile(root, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !strings.Contains(err.Error(), "not a directory") {
+			t.Errorf("got error %q; want one saying root is not a directory", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error after root was created as a file")
+	}
+}
+
+func TestCheckWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(sentinel string, interval time.Duration) {
+		watchdogSentinel = sentinel
+		flagWatchdog = interval
+	}(watchdogSentinel, flagWatchdog)
+	watchdogSentinel = ".reflex-watchdog-test"
+	flagWatchdog = time.Second
+	sentinel := filepath.Join(dir, watchdogSentinel)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(chan string, 100)
+	done := make(chan error, 1)
+	reflexes := []*Reflex{newTestReflex(t, "--", "true")}
+	stopped := make(chan struct{})
+	go func() {
+		watch(dir, watcher, names, done, reflexesFunc(reflexes))
+		close(stopped)
+	}()
+	// Stop watch before the deferred function resets watchdogSentinel.
+	defer func() {
+		watcher.Close()
+		<-stopped
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if !checkWatcher(dir) {
+		t.Error("checkWatcher: got false for a working watcher")
+	}
+	// Simulate a watcher that has silently stopped working.
+	if err := watcher.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if checkWatcher(dir) {
+		t.Error("checkWatcher: got true after the watch was removed")
+	}
+	if _, err := os.Stat(sentinel); !os.IsNotExist(err) {
+		t.Errorf("sentinel file not removed (stat error: %v)", err)
+	}
+	select {
+	case name := <-names:
+		t.Errorf("got name %q; want the sentinel file not to be reported", name)
+	case err := <-done:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestRootedName(t *testing.T) {
+	defer func(dirs map[string]bool) { watchDirs = dirs }(watchDirs)
+	watchDirs = map[string]bool{"../lib": true, "/src/b/": true}
+	for _, tt := range []struct {
+		root string
+		name string
+		want string
+	}{
+		{".", "a.go", "a.go"},
+		{"../lib", "a.go", "../lib/a.go"},
+		{"../lib", "x/y/", "../lib/x/y/"},
+		{"../lib", "", ""},
+		{"../lib", "./", "../lib/"},
+		{"/src/b/", "c/d.go", "/src/b/c/d.go"},
+	} {
+		if got := rootedName(tt.root, tt.name); got != tt.want {
+			t.Errorf("rootedName(%q, %q): got %q; want %q", tt.root, tt.name, got, tt.want)
+		}
+		if tt.name == "" {
+			continue
+		}
+		if root, rel := splitRoot(tt.want); root != tt.root || rel != tt.name {
+			t.Errorf("splitRoot(%q): got %q, %q; want %q, %q", tt.want, root, rel, tt.root, tt.name)
+		}
+	}
+}
+
+func TestWatchDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dirs map[string]bool) { watchDirs = dirs }(watchDirs)
+	watchDirs = map[string]bool{dir: true}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(chan string, 100)
+	done := make(chan error, 1)
+	reflexes := []*Reflex{newTestReflex(t, "--", "true")}
+	stopped := make(chan struct{})
+	go func() {
+		watch(dir, watcher, names, done, reflexesFunc(reflexes))
+		close(stopped)
+	}()
+	defer func() {
+		watcher.Close()
+		<-stopped
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.ToSlash(dir) + "/a.go"
+	select {
+	case name := <-names:
+		if name != want {
+			t.Errorf("got name %q; want %q", name, want)
+		}
+	case err := <-done:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("change in --watch-dir root not reported")
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	defer func(follow bool) { flagFollowSymlinks = follow }(flagFollowSymlinks)
+
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(lib)
+	if err := os.Mkdir(filepath.Join(lib, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// dir/lib is the shared directory; dir/lib/sub/back leads back to dir,
+	// and dir/again to the shared directory a second time.
+	for _, link := range []struct{ target, name string }{
+		{lib, filepath.Join(dir, "lib")},
+		{lib, filepath.Join(dir, "again")},
+		{dir, filepath.Join(lib, "sub", "back")},
+	} {
+		if err := os.Symlink(link.target, link.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reflexes := []*Reflex{newTestReflex(t, "--", "true")}
+	for _, tt := range []struct {
+		follow bool
+		want   int
+	}{
+		{false, 1}, // dir
+		{true, 3},  // dir, again, and again/sub
+	} {
+		flagFollowSymlinks = tt.follow
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := addWatches(dir, dir, watcher, reflexesFunc(reflexes)); err != nil {
+			t.Fatal(err)
+		}
+		watchesMu.Lock()
+		got := watchCounts[watcher]
+		delete(watchCounts, watcher)
+		delete(watchedDirs, watcher)
+		watchesMu.Unlock()
+		watcher.Close()
+		if got != tt.want {
+			t.Errorf("with --follow-symlinks=%t: got %d watches; want %d", tt.follow, got, tt.want)
+		}
+	}
+
+	flagFollowSymlinks = true
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(chan string, 100)
+	done := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		watch(dir, watcher, names, done, reflexesFunc(reflexes))
+		close(stopped)
+	}()
+	defer func() {
+		watcher.Close()
+		<-stopped
+		watchesMu.Lock()
+		delete(watchCounts, watcher)
+		delete(watchedDirs, watcher)
+		watchesMu.Unlock()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := ioutil.WriteFile(filepath.Join(lib, "sub", "a.go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-names:
+		// The walk is in lexical order, so the shared directory
+		// is watched through again, not lib.
+		if want := "again/sub/a.go"; name != want {
+			t.Errorf("got name %q; want %q", name, want)
+		}
+	case err := <-done:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("change in a symlinked directory not reported")
+	}
+}
+
+func TestExcludeDir(t *testing.T) {
+	defer func(dirs []string) { flagExcludeDirs = dirs }(flagExcludeDirs)
+	flagExcludeDirs = []string{"node_modules", ".cache*", "web/dist"}
+
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"", ""},
+		{"src/", ""},
+		{"node_modules/", "node_modules"},
+		{"a/b/node_modules/", "node_modules"},
+		{"node_modules_old/", ""},
+		{".cache-loader/", ".cache*"},
+		{"web/dist/", "web/dist"},
+		{"api/web/dist/", ""},
+		{"dist/", ""},
+	} {
+		if got := excludedDir(tt.name); got != tt.want {
+			t.Errorf("excludedDir(%q): got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"src", "node_modules/pkg/lib", "web/dist/js"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	reflexes := []*Reflex{newTestReflex(t, "--", "true")}
+	if err := addWatches(dir, dir, watcher, reflexesFunc(reflexes)); err != nil {
+		t.Fatal(err)
+	}
+	watchesMu.Lock()
+	got := watchCounts[watcher]
+	delete(watchCounts, watcher)
+	watchesMu.Unlock()
+	// dir, src, and web.
+	if want := 3; got != want {
+		t.Errorf("addWatches with --exclude-dir: got %d watches; want %d", got, want)
+	}
+}
+
+func TestRewatchRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflex-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "vendor"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reflexes change (as on a reload) from one that excludes vendor
+	// to one that doesn't.
+	var mu sync.Mutex
+	current := []*Reflex{newTestReflex(t, "-R", "^vendor/", "--", "true")}
+	reflexes := func() []*Reflex {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(chan string, 100)
+	done := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		watch(dir, watcher, names, done, reflexes)
+		close(stopped)
+	}()
+	defer func() {
+		watcher.Close()
+		<-stopped
+		watchesMu.Lock()
+		delete(watchCounts, watcher)
+		watchesMu.Unlock()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	current = []*Reflex{newTestReflex(t, "--", "true")}
+	mu.Unlock()
+	rewatchRoots()
+	time.Sleep(100 * time.Millisecond)
+	if err := ioutil.WriteFile(filepath.Join(dir, "vendor", "lib.go"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case name := <-names:
+			if name == "vendor/lib.go" {
+				return
+			}
+		case err := <-done:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("change in a directory excluded before rewatchRoots not reported")
+		}
+	}
+}